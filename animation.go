@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// gifHeader is a common prefix of GIF87a and GIF89a files
+const gifHeader = "GIF8"
+
+// maxAnimationPixels is max number of pixels of all frames of animation, which are composed to full size images
+// every pixel takes 4 bytes, so composed frames take up to 200 MB
+const maxAnimationPixels = 50000000
+
+// checkAnimationSize checks that all frames of GIF composed to full size images fit pixel budget
+// size of image is read from header and frames are counted without decoding them
+func checkAnimationSize(data []byte) error {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	frames, err := countGIFFrames(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if pixels := int64(config.Width) * int64(config.Height) * int64(frames); pixels > maxAnimationPixels {
+		return newRequestError("animation_too_large", fmt.Errorf("animation of %d frames %dx%d has more than %d pixels",
+			frames, config.Width, config.Height, maxAnimationPixels))
+	}
+
+	return nil
+}
+
+// countGIFFrames returns number of image descriptors of GIF, extensions and image data are skipped
+func countGIFFrames(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+
+	// header and logical screen descriptor
+	var screen [13]byte
+	if _, err := io.ReadFull(br, screen[:]); err != nil {
+		return 0, err
+	}
+	if err := skipColorTable(br, screen[10]); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for {
+		block, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch block {
+		case 0x21: // extension: label and data sub-blocks
+			if _, err = br.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor, local color table, LZW code size and data sub-blocks
+			var descriptor [9]byte
+			if _, err = io.ReadFull(br, descriptor[:]); err != nil {
+				return 0, err
+			}
+			if err = skipColorTable(br, descriptor[8]); err != nil {
+				return 0, err
+			}
+			if _, err = br.ReadByte(); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("unknown gif block 0x%02x", block)
+		}
+
+		if err = skipSubBlocks(br); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// skipColorTable skips color table, which follows descriptor with flags
+func skipColorTable(br *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+
+	_, err := br.Discard(3 << (flags&0x07 + 1))
+	return err
+}
+
+// skipSubBlocks skips data sub-blocks up to block terminator
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil || size == 0 {
+			return err
+		}
+
+		if _, err = br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// composeFrames renders frames of GIF to full size images
+// frames of GIF may cover part of image only, so every frame is drawn over previous ones
+// and disposal method of frame is applied before next frame is drawn
+func composeFrames(g *gif.GIF) []image.Image {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewNRGBA(bounds)
+
+	frames := make([]image.Image, 0, len(g.Image))
+	for n, frame := range g.Image {
+		var disposal byte
+		if n < len(g.Disposal) {
+			disposal = g.Disposal[n]
+		}
+
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = toNRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, toNRGBA(canvas))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames
+}
+
+// gifPalettes returns palettes of frames of resized animation
+// global palette of GIF is used for all frames, one palette keeps colors of frames consistent
+// without global palette, local palettes of frames are merged if they fit in one palette,
+// otherwise every frame keeps its own palette
+func gifPalettes(g *gif.GIF) []color.Palette {
+	palettes := make([]color.Palette, len(g.Image))
+	if global, ok := g.Config.ColorModel.(color.Palette); ok && len(global) > 0 {
+		p := withTransparent(global)
+		for n := range palettes {
+			palettes[n] = p
+		}
+		return palettes
+	}
+
+	var merged color.Palette
+	seen := make(map[color.RGBA64]bool)
+	for n, frame := range g.Image {
+		palettes[n] = withTransparent(frame.Palette)
+		for _, c := range frame.Palette {
+			key := color.RGBA64Model.Convert(c).(color.RGBA64)
+			if !seen[key] {
+				seen[key] = true
+				merged = append(merged, c)
+			}
+		}
+	}
+
+	if len(merged) < 256 {
+		p := withTransparent(merged)
+		for n := range palettes {
+			palettes[n] = p
+		}
+	}
+
+	return palettes
+}
+
+// withTransparent returns palette with transparent color, the last color of full palette is replaced with it
+func withTransparent(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+
+	result := append(color.Palette{}, p...)
+	if len(result) < 256 {
+		return append(result, color.Transparent)
+	}
+	result[len(result)-1] = color.Transparent
+
+	return result
+}
+
+// quantize converts image to paletted one, every pixel gets the nearest color of palette
+// dithering is not used, so static areas of animation do not flicker
+// pixels with alpha below half are transparent, the rest are opaque
+func quantize(img image.Image, p color.Palette) *image.Paletted {
+	src := toNRGBA(img)
+	dst := image.NewPaletted(src.Rect, p)
+	transparent := uint8(p.Index(color.Transparent))
+
+	indexes := make(map[color.NRGBA]uint8)
+	for n, m := 0, 0; n < len(src.Pix); n, m = n+4, m+1 {
+		c := color.NRGBA{src.Pix[n], src.Pix[n+1], src.Pix[n+2], 255}
+		if src.Pix[n+3] < 128 {
+			dst.Pix[m] = transparent
+			continue
+		}
+
+		index, ok := indexes[c]
+		if !ok {
+			index = uint8(p.Index(c))
+			indexes[c] = index
+		}
+		dst.Pix[m] = index
+	}
+
+	return dst
+}
+
+// encodeGIF encodes frames with delays in 100ths of second and loop count to GIF with palettes of frames
+// every frame is a full size image, so it replaces previous frame
+func encodeGIF(writer io.Writer, frames []image.Image, delays []int, loopCount int, palettes []color.Palette) error {
+	bounds := frames[0].Bounds()
+	g := &gif.GIF{
+		LoopCount: loopCount,
+		Config:    image.Config{ColorModel: palettes[0], Width: bounds.Dx(), Height: bounds.Dy()},
+	}
+
+	for n, frame := range frames {
+		g.Image = append(g.Image, quantize(frame, palettes[n]))
+		g.Delay = append(g.Delay, delays[n])
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+
+	return gif.EncodeAll(writer, g)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposeFrames(t *testing.T) {
+	f, err := os.Open("testdata/animated.gif")
+	require.NoError(t, err)
+	defer f.Close()
+
+	g, err := gif.DecodeAll(f)
+	require.NoError(t, err)
+
+	red, green, yellow := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 255}, color.NRGBA{255, 255, 0, 255}
+	frames := composeFrames(g)
+	require.Len(t, frames, 3)
+
+	// the second frame covers part of image only and is disposed to background
+	assert.Equal(t, red, toNRGBA(frames[0]).NRGBAAt(15, 15))
+	assert.Equal(t, green, toNRGBA(frames[1]).NRGBAAt(15, 15))
+	assert.Equal(t, red, toNRGBA(frames[1]).NRGBAAt(0, 0))
+	assert.Equal(t, color.NRGBA{}, toNRGBA(frames[2]).NRGBAAt(15, 15))
+	assert.Equal(t, yellow, toNRGBA(frames[2]).NRGBAAt(25, 15))
+	assert.Equal(t, red, toNRGBA(frames[2]).NRGBAAt(35, 15))
+}
+
+func TestImagesAnimation(t *testing.T) {
+	t.Run("all frames", func(t *testing.T) {
+		i := decodeTestImage(t, "testdata/animated.gif")
+		assert.Equal(t, 3, i.Frames())
+
+		require.NoError(t, i.Resize(context.Background(), 20, 0, 0))
+		require.NoError(t, i.Filter(context.Background(), "grayscale", 1))
+		require.NoError(t, i.Mask(context.Background(), maskCircle, 0, 0, defaultBorderColor))
+
+		buffer, err := i.Encode(context.Background(), "gif", defaultBackground)
+		require.NoError(t, err)
+
+		g, err := gif.DecodeAll(buffer)
+		require.NoError(t, err)
+		require.Len(t, g.Image, 3)
+		assert.Equal(t, []int{10, 20, 30}, g.Delay)
+		assert.Equal(t, 2, g.LoopCount)
+		assert.Equal(t, 20, g.Config.Width)
+		assert.Equal(t, 15, g.Config.Height)
+
+		for _, frame := range g.Image {
+			assert.Equal(t, g.Image[0].Palette, frame.Palette)
+
+			// corners are cut by mask, center is gray
+			_, _, _, a := frame.At(0, 0).RGBA()
+			assert.Equal(t, uint32(0), a)
+			r, g, b, _ := frame.At(10, 2).RGBA()
+			assert.InDelta(t, r>>8, g>>8, 24)
+			assert.InDelta(t, g>>8, b>>8, 24)
+		}
+	})
+	t.Run("still", func(t *testing.T) {
+		i := decodeTestImage(t, "testdata/animated.gif")
+		require.NoError(t, i.Frame(1))
+		assert.Equal(t, 1, i.Frames())
+
+		require.NoError(t, i.Resize(context.Background(), 40, 30, 0))
+		assert.Equal(t, color.NRGBA{0, 255, 0, 255}, toNRGBA(i.resized).NRGBAAt(15, 15))
+
+		buffer, err := i.Encode(context.Background(), "gif", defaultBackground)
+		require.NoError(t, err)
+
+		g, err := gif.DecodeAll(bytes.NewReader(buffer.Bytes()))
+		require.NoError(t, err)
+		assert.Len(t, g.Image, 1)
+	})
+	t.Run("first frame to jpeg", func(t *testing.T) {
+		i := decodeTestImage(t, "testdata/animated.gif")
+		require.NoError(t, i.Resize(context.Background(), 20, 0, 0))
+
+		_, err := i.Encode(context.Background(), "jpeg", defaultBackground)
+		assert.NoError(t, err)
+	})
+	t.Run("invalid frame", func(t *testing.T) {
+		err := decodeTestImage(t, "testdata/animated.gif").Frame(3)
+		assert.Equal(t, "invalid_frame", newErrorBody(400, err).Code)
+	})
+}
+
+func TestAnimationTooLarge(t *testing.T) {
+	// frames are tiny, but all of them are composed to full size of logical screen
+	frame := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black})
+	g := &gif.GIF{
+		Image:  []*image.Paletted{frame, frame, frame},
+		Delay:  []int{0, 0, 0},
+		Config: image.Config{ColorModel: frame.Palette, Width: 5000, Height: 5000},
+	}
+
+	var buffer bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&buffer, g))
+
+	frames, err := countGIFFrames(bytes.NewReader(buffer.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 3, frames)
+
+	err = (&Images{}).Decode(context.Background(), &buffer)
+	assert.Equal(t, "animation_too_large", newErrorBody(400, err).Code)
+
+	g.Image, g.Delay = g.Image[:1], g.Delay[:1]
+	buffer.Reset()
+	require.NoError(t, gif.EncodeAll(&buffer, g))
+	assert.NoError(t, (&Images{}).Decode(context.Background(), &buffer))
+}
+
+func TestLocalPalettes(t *testing.T) {
+	// frames have local palettes only, each palette has shades of one color
+	shades := func(size int, shade func(uint8) color.Color) color.Palette {
+		p := make(color.Palette, size)
+		for n := range p {
+			p[n] = shade(uint8(255 - n))
+		}
+		return p
+	}
+	encode := func(t *testing.T, size int) *gif.GIF {
+		red := shades(size, func(v uint8) color.Color { return color.RGBA{v, 0, 0, 255} })
+		blue := shades(size, func(v uint8) color.Color { return color.RGBA{0, 0, v, 255} })
+		src := &gif.GIF{
+			Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 8, 8), red), image.NewPaletted(image.Rect(0, 0, 8, 8), blue)},
+			Delay: []int{10, 10},
+		}
+
+		var buffer bytes.Buffer
+		require.NoError(t, gif.EncodeAll(&buffer, src))
+
+		i := &Images{}
+		require.NoError(t, i.Decode(context.Background(), &buffer))
+		require.NoError(t, i.Resize(context.Background(), 4, 0, 0))
+		result, err := i.Encode(context.Background(), "gif", defaultBackground)
+		require.NoError(t, err)
+
+		g, err := gif.DecodeAll(result)
+		require.NoError(t, err)
+		require.Len(t, g.Image, 2)
+		assert.Equal(t, color.RGBA{255, 0, 0, 255}, color.RGBAModel.Convert(g.Image[0].At(1, 1)))
+		assert.Equal(t, color.RGBA{0, 0, 255, 255}, color.RGBAModel.Convert(g.Image[1].At(1, 1)))
+
+		return g
+	}
+
+	t.Run("merged", func(t *testing.T) {
+		g := encode(t, 16)
+		assert.Equal(t, g.Image[0].Palette, g.Image[1].Palette)
+	})
+	t.Run("per frame", func(t *testing.T) {
+		g := encode(t, 200)
+		assert.NotEqual(t, g.Image[0].Palette, g.Image[1].Palette)
+	})
+}
+
+// countdownContext is a context, which is done after number of checks
+type countdownContext struct {
+	context.Context
+	checks int
+}
+
+func (c *countdownContext) Err() error {
+	if c.checks <= 0 {
+		return context.Canceled
+	}
+	c.checks--
+
+	return nil
+}
+
+func TestAnimationCanceled(t *testing.T) {
+	// context is done after the first of three frames
+	i := decodeTestImage(t, "testdata/animated.gif")
+	err := i.Resize(&countdownContext{context.Background(), 2}, 20, 0, 0)
+	assert.Equal(t, context.Canceled, err)
+
+	require.NoError(t, i.Resize(context.Background(), 20, 0, 0))
+	err = i.Filter(&countdownContext{context.Background(), 2}, "grayscale", 1)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -1,16 +1,52 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/ReneKroon/ttlcache"
 )
 
+// Cache is an interface for storage of original and resized images
+// images are identified by key, resized images additionally by variant name, e.g. "100x100"
+// originals are available as local files, SetOriginal returns path the file is actually stored at
+// resized images are returned as bytes, SetVariant takes ownership of file with resized image
+// every resized image has response headers stored along, e.g. ETag
+// Stats returns named counters, e.g. "images" or "usage_bytes"
+type Cache interface {
+	GetOriginal(key string) (string, bool)
+	SetOriginal(key, path string) (string, error)
+	GetVariant(key, name string) ([]byte, http.Header, bool)
+	SetVariant(key, name, path string, header http.Header) error
+	Remove(key string)
+	Stats() map[string]int64
+}
+
+// variantName returns name of resized image of width and height
+func variantName(width, height uint64) string {
+	return fmt.Sprintf("%dx%d", width, height)
+}
+
+// variant is a resized image stored in file with its response headers
+type variant struct {
+	Path   string      `json:"path"`
+	Header http.Header `json:"header"`
+}
+
 // MetaData contains local file paths to original image and to all resized images
 // original is a string with path to original image
-// resized is a map with all resized images:
-// { width1: { height1: path11, height2: path12 }, width2: {height1: path21}}
+// resized is a map with all resized images by variant name:
+// { "100x100": variant1, "200x0": variant2 }
 type MetaData struct {
+	mu       sync.Mutex
 	original string
-	resized  map[uint64]map[uint64]string
+	resized  map[string]*variant
 }
 
 // NewMetaData returns new MetaData object
@@ -18,81 +54,294 @@ type MetaData struct {
 func NewMetaData(ofp string) *MetaData {
 	return &MetaData{
 		original: ofp,
-		resized:  make(map[uint64]map[uint64]string),
+		resized:  make(map[string]*variant),
+	}
+}
+
+// files returns paths to original image and to all resized images
+func (md *MetaData) files() []string {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	files := []string{md.original}
+	for _, v := range md.resized {
+		files = append(files, v.Path)
+	}
+
+	return files
+}
+
+// snapshot returns copy of metadata content
+func (md *MetaData) snapshot() (string, map[string]*variant) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	resized := make(map[string]*variant, len(md.resized))
+	for name, v := range md.resized {
+		resized[name] = v
 	}
+
+	return md.original, resized
 }
 
-// SetToCache puts into cache image metadata struct by image Etag
-func (fx *ImageFixture) SetToCache(c *ttlcache.Cache, reg Registry) {
-	md := NewMetaData(fx.File.Path)
-	c.Set(fx.File.Etag, md)
+// removeResized deletes resized image with path from metadata
+func (md *MetaData) removeResized(path string) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
 
-	reg.AddFileToRegistry(fx.File.Path)
+	for name, v := range md.resized {
+		if v.Path == path {
+			delete(md.resized, name)
+		}
+	}
 }
 
-func (fx *ImageFixture) getImageMetaDataFromCache(c *ttlcache.Cache) (*MetaData, bool) {
-	value, exists := c.Get(fx.File.Etag)
+// NewExpirationCallback returns cache callback that removes temp files of expired image
+// original and all resized images are deleted from disk, from registry and from store index
+func NewExpirationCallback(reg *Registry, logger *log.Logger) func(key string, value interface{}) {
+	return func(key string, value interface{}) {
+		md, ok := value.(*MetaData)
+		if !ok {
+			return
+		}
+
+		errs := []error{reg.deleteIndex(key)}
+		for _, file := range md.files() {
+			errs = append(errs, reg.RemoveFileFromRegistry(key, file))
+		}
+
+		for _, err := range errs {
+			if err != nil {
+				logger.SetPrefix("ERROR: ")
+				logger.Println("expire", key, "| ", err.Error())
+			}
+		}
+	}
+}
+
+// TTLCache is a Cache backend with expiring keys in memory and images in files
+// files are tracked by Registry, so disk usage limit and persistent store apply
+type TTLCache struct {
+	cache  *ttlcache.Cache
+	reg    *Registry
+	logger *log.Logger
+	expire func(key string, value interface{})
+	// mu makes lookup and insert of original atomic, so concurrent misses of key share one MetaData
+	mu     sync.Mutex
+	hits   int64
+	misses int64
+}
+
+// NewTTLCache returns new TTLCache object
+// ttl is a lifetime of image in cache, 0 means forever
+// files of expired images are removed right away
+func NewTTLCache(ttl time.Duration, reg *Registry, logger *log.Logger) *TTLCache {
+	c := ttlcache.NewCache()
+	if ttl > 0 {
+		c.SetTTL(ttl)
+	}
+	expire := NewExpirationCallback(reg, logger)
+	c.SetExpirationCallback(expire)
+
+	return &TTLCache{cache: c, reg: reg, logger: logger, expire: expire}
+}
+
+// Restore loads images from registry persistent store
+// returns number of restored images
+func (tc *TTLCache) Restore(ttl time.Duration) (int, error) {
+	if tc.reg.store == nil {
+		return 0, nil
+	}
+
+	restored, err := tc.reg.store.Restore(tc.cache, tc.reg, ttl)
+	if err != nil {
+		return restored, err
+	}
+
+	return restored, tc.evict("")
+}
+
+func (tc *TTLCache) metadata(key string) (*MetaData, bool) {
+	value, exists := tc.cache.Get(key)
 	if !exists {
 		return nil, false
 	}
 
 	md, ok := value.(*MetaData)
 	if !ok {
-		fx.RemoveFromCache(c)
+		tc.cache.Remove(key)
+		return nil, false
 	}
 	return md, true
 }
 
-// GetFromCache extracts from cache image metadata struct by image Etag
-func (fx *ImageFixture) GetFromCache(c *ttlcache.Cache) bool {
-	md, exists := fx.getImageMetaDataFromCache(c)
+// GetOriginal returns path to original image and marks it as recently used
+func (tc *TTLCache) GetOriginal(key string) (string, bool) {
+	md, exists := tc.metadata(key)
 	if !exists {
-		return false
+		return "", false
+	}
+
+	tc.reg.Touch(key, md.original)
+	return md.original, true
+}
+
+// SetOriginal puts into cache image metadata struct with path to original image
+// in persistent mode original is moved to store
+// if original is already stored by concurrent request, its metadata is kept and file at path is deleted
+func (tc *TTLCache) SetOriginal(key, path string) (string, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if md, exists := tc.metadata(key); exists {
+		tc.reg.Touch(key, md.original)
+		if err := os.Remove(path); err != nil {
+			tc.logger.SetPrefix("ERROR: ")
+			tc.logger.Println("remove duplicate original", key, "| ", err.Error())
+		}
+		return md.original, nil
+	}
+
+	path, err := tc.reg.persist(path)
+	if err != nil {
+		return "", err
 	}
 
-	fx.File.Path = md.original
-	return true
+	md := NewMetaData(path)
+	tc.cache.Set(key, md)
+
+	tc.reg.AddOriginalToRegistry(key, path)
+	if err = tc.reg.saveIndex(key, md); err != nil {
+		return "", err
+	}
+
+	tc.logEvictError(tc.evict(key))
+	return path, nil
 }
 
-// UpdateValueInCache updates image metadata struct by image Etag
-// i.e. if new resized image added
-func (fx *ImageFixture) UpdateValueInCache(c *ttlcache.Cache, resized string, reg Registry) {
-	md, exists := fx.getImageMetaDataFromCache(c)
+// GetVariant searches in cache resized image by variant name and marks it as recently used
+func (tc *TTLCache) GetVariant(key, name string) ([]byte, http.Header, bool) {
+	v, exists := tc.variant(key, name)
 	if !exists {
-		// wtf?
-		return
+		atomic.AddInt64(&tc.misses, 1)
+		return nil, nil, false
 	}
 
-	_, ok := md.resized[fx.Params.Width]
-	if !ok {
-		md.resized[fx.Params.Width] = make(map[uint64]string)
+	b, err := ioutil.ReadFile(v.Path)
+	if err != nil {
+		atomic.AddInt64(&tc.misses, 1)
+		return nil, nil, false
 	}
-	md.resized[fx.Params.Width][fx.Params.Height] = resized
 
-	reg.AddFileToRegistry(resized)
+	atomic.AddInt64(&tc.hits, 1)
+	tc.reg.Touch(key, v.Path)
+	return b, v.Header, true
 }
 
-// RemoveFromCache deletes image metadata struct by image Etag
-func (fx *ImageFixture) RemoveFromCache(c *ttlcache.Cache) {
-	c.Remove(fx.File.Etag)
+// TouchVariant marks resized image as recently used and prolongs lifetime of image without reading it
+func (tc *TTLCache) TouchVariant(key, name string) bool {
+	v, exists := tc.variant(key, name)
+	if exists {
+		tc.reg.Touch(key, v.Path)
+	}
+
+	return exists
 }
 
-// FindInCache searches in cache resized image by width and height
-func (fx *ImageFixture) FindInCache(c *ttlcache.Cache) (string, bool) {
-	md, exists := fx.getImageMetaDataFromCache(c)
+func (tc *TTLCache) variant(key, name string) (*variant, bool) {
+	md, exists := tc.metadata(key)
 	if !exists {
-		return "", false
+		return nil, false
 	}
 
-	_, ok := md.resized[fx.Params.Width]
-	if !ok {
-		return "", false
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	v, ok := md.resized[name]
+	return v, ok
+}
+
+// SetVariant updates image metadata struct with path to resized image and its headers
+// in persistent mode resized image is moved to store
+func (tc *TTLCache) SetVariant(key, name, path string, header http.Header) error {
+	md, exists := tc.metadata(key)
+	if !exists {
+		// original expired while image was resized, nothing to attach variant to
+		return os.Remove(path)
 	}
 
-	value, ok := md.resized[fx.Params.Width][fx.Params.Height]
-	if !ok {
-		return "", false
+	path, err := tc.reg.persist(path)
+	if err != nil {
+		return err
+	}
+
+	md.mu.Lock()
+	md.resized[name] = &variant{Path: path, Header: header}
+	md.mu.Unlock()
+
+	tc.reg.AddResizedToRegistry(key, path)
+	if err = tc.reg.saveIndex(key, md); err != nil {
+		return err
+	}
+
+	tc.logEvictError(tc.evict(key))
+	return nil
+}
+
+// Remove deletes image metadata struct by key and files of image
+// ttlcache does not call expiration callback on removal, so files are released here
+func (tc *TTLCache) Remove(key string) {
+	value, exists := tc.cache.Get(key)
+	if exists && tc.cache.Remove(key) {
+		tc.expire(key, value)
 	}
+}
 
-	return value, true
+// Stats returns number of images in cache, disk usage, hits and misses of resized images
+func (tc *TTLCache) Stats() map[string]int64 {
+	usage, limit := tc.reg.Usage()
+	return map[string]int64{
+		"images":      int64(tc.cache.Count()),
+		"files":       int64(tc.reg.Len()),
+		"usage_bytes": usage,
+		"limit_bytes": limit,
+		"disk_hits":   atomic.LoadInt64(&tc.hits),
+		"disk_misses": atomic.LoadInt64(&tc.misses),
+	}
+}
+
+// evict removes least recently used files while disk usage exceeds registry limit
+// files of image with key keep are never evicted
+// evicted resized images are deleted from image metadata, evicted originals from cache
+func (tc *TTLCache) evict(keep string) error {
+	evicted, err := tc.reg.Evict(keep)
+	for _, rec := range evicted {
+		if rec.original {
+			tc.cache.Remove(rec.key)
+			if derr := tc.reg.deleteIndex(rec.key); err == nil {
+				err = derr
+			}
+			continue
+		}
+
+		md, exists := tc.metadata(rec.key)
+		if !exists {
+			continue
+		}
+
+		md.removeResized(rec.file)
+		if serr := tc.reg.saveIndex(rec.key, md); err == nil {
+			err = serr
+		}
+	}
+
+	return err
+}
+
+// logEvictError writes eviction problem to log, client request is not affected
+func (tc *TTLCache) logEvictError(err error) {
+	if err != nil {
+		tc.logger.SetPrefix("ERROR: ")
+		tc.logger.Println("evict temp files | ", err.Error())
+	}
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpirationCallback(t *testing.T) {
+	reg := NewRegistry()
+	defer reg.Cleanup()
+
+	cache := NewTTLCache(50*time.Millisecond, reg, log.New(ioutil.Discard, "", 0))
+
+	key := "70c8cb786769432edd9f1cd55cf1b135"
+	_, err := cache.SetOriginal(key, tempFile(t, []byte("original")))
+	require.NoError(t, err)
+	require.NoError(t, cache.SetVariant(key, "100x100", tempFile(t, []byte("100x100")), nil))
+	require.NoError(t, cache.SetVariant(key, "100x200", tempFile(t, []byte("100x200")), nil))
+	require.NoError(t, cache.SetVariant(key, "300x300", tempFile(t, []byte("300x300")), nil))
+
+	other := tempFile(t, []byte("other"))
+	reg.AddResizedToRegistry("other", other)
+
+	md, ok := cache.metadata(key)
+	require.True(t, ok)
+	files := md.files()
+	require.Len(t, files, 4)
+
+	// ttlcache calls expiration callback in background once key expires
+	require.Eventually(t, func() bool { return reg.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	for _, file := range files {
+		_, err := os.Stat(file)
+		assert.True(t, os.IsNotExist(err), file)
+	}
+
+	_, err = os.Stat(other)
+	assert.NoError(t, err)
+}
+
+func TestTTLCacheSetOriginalTwice(t *testing.T) {
+	reg := NewRegistry()
+	defer reg.Cleanup()
+
+	cache := NewTTLCache(0, reg, log.New(ioutil.Discard, "", 0))
+
+	// the second of concurrent misses gets original of the first one, its own copy is deleted
+	key := "70c8cb786769432edd9f1cd55cf1b135"
+	first, err := cache.SetOriginal(key, tempFile(t, []byte("original")))
+	require.NoError(t, err)
+	require.NoError(t, cache.SetVariant(key, "100x100", tempFile(t, []byte("100x100")), nil))
+
+	duplicate := tempFile(t, []byte("original"))
+	path, err := cache.SetOriginal(key, duplicate)
+	require.NoError(t, err)
+	assert.Equal(t, first, path)
+	_, err = os.Stat(duplicate)
+	assert.True(t, os.IsNotExist(err))
+
+	_, _, ok := cache.GetVariant(key, "100x100")
+	assert.True(t, ok)
+	assert.Equal(t, 2, reg.Len())
+}
+
+func TestTTLCacheRemove(t *testing.T) {
+	reg := NewRegistry()
+	defer reg.Cleanup()
+
+	cache := NewTTLCache(0, reg, log.New(ioutil.Discard, "", 0))
+
+	key := "70c8cb786769432edd9f1cd55cf1b135"
+	_, err := cache.SetOriginal(key, tempFile(t, []byte("original")))
+	require.NoError(t, err)
+	require.NoError(t, cache.SetVariant(key, "100x100", tempFile(t, []byte("100x100")), nil))
+
+	md, ok := cache.metadata(key)
+	require.True(t, ok)
+	files := md.files()
+
+	cache.Remove(key)
+	_, ok = cache.GetOriginal(key)
+	assert.False(t, ok)
+	assert.Equal(t, 0, reg.Len())
+	for _, file := range files {
+		_, err := os.Stat(file)
+		assert.True(t, os.IsNotExist(err), file)
+	}
+}
+
+func TestTTLCacheEviction(t *testing.T) {
+	reg := NewRegistry()
+	reg.SetLimit(250)
+	defer reg.Cleanup()
+
+	cache := NewTTLCache(0, reg, log.New(ioutil.Discard, "", 0))
+
+	first, second := "first", "second"
+
+	// first image with two resized versions
+	_, err := cache.SetOriginal(first, tempFile(t, make([]byte, 100)))
+	require.NoError(t, err)
+	small := tempFile(t, make([]byte, 10))
+	require.NoError(t, cache.SetVariant(first, "10x10", small, nil))
+	require.NoError(t, cache.SetVariant(first, "50x50", tempFile(t, make([]byte, 50)), nil))
+
+	stats := cache.Stats()
+	assert.Equal(t, int64(160), stats["usage_bytes"])
+	assert.Equal(t, int64(250), stats["limit_bytes"])
+
+	// small version becomes recently used
+	_, _, ok := cache.GetVariant(first, "10x10")
+	require.True(t, ok)
+
+	// second image does not fit, least recently used resized image goes first
+	_, err = cache.SetOriginal(second, tempFile(t, make([]byte, 100)))
+	require.NoError(t, err)
+
+	_, _, ok = cache.GetVariant(first, "50x50")
+	assert.False(t, ok)
+	_, _, ok = cache.GetVariant(first, "10x10")
+	assert.True(t, ok)
+	assert.Equal(t, int64(210), cache.Stats()["usage_bytes"])
+
+	// no resized images of other pictures left, so original is evicted with whole cache record
+	require.NoError(t, cache.SetVariant(second, "10x10", tempFile(t, make([]byte, 80)), nil))
+
+	_, ok = cache.GetOriginal(first)
+	assert.False(t, ok)
+	_, err = os.Stat(small)
+	assert.True(t, os.IsNotExist(err))
+
+	stats = cache.Stats()
+	assert.Equal(t, int64(180), stats["usage_bytes"])
+	assert.Equal(t, int64(2), stats["files"])
+	assert.Equal(t, int64(1), stats["images"])
+}
+
+// tempFile writes content to new temp file, which can be handed over to cache
+func tempFile(t *testing.T, content []byte) string {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write(content)
+	require.NoError(t, err)
+	return f.Name()
+}
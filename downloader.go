@@ -1,18 +1,119 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 
 	"github.com/pkg/errors"
 )
 
+// OriginError describes failed download of image from origin
+// Code tells client what happened, e.g. "origin_not_found" or "origin_timeout"
+// Status is a response status for client
+type OriginError struct {
+	Code   string
+	Status int
+	Err    error
+}
+
+func (e *OriginError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns underlying error
+func (e *OriginError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns underlying error
+func (e *OriginError) Unwrap() error {
+	return e.Err
+}
+
+// errRedirectNotAllowed tells that origin redirected request to host, which is not allowed
+var errRedirectNotAllowed = errors.New("redirect is not allowed")
+
+// newOriginError classifies error of request to origin
+func newOriginError(err error) *OriginError {
+	if errors.Is(err, errRedirectNotAllowed) {
+		return &OriginError{Code: "origin_redirect_not_allowed", Status: http.StatusBadGateway, Err: err}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &OriginError{Code: "origin_timeout", Status: http.StatusGatewayTimeout, Err: err}
+	}
+
+	if isTLSError(err) {
+		return &OriginError{Code: "origin_tls_error", Status: http.StatusBadGateway, Err: err}
+	}
+
+	return &OriginError{Code: "origin_unreachable", Status: http.StatusBadGateway, Err: err}
+}
+
+// newOriginStatusError classifies non-200 response of origin
+func newOriginStatusError(resp *http.Response) *OriginError {
+	err := fmt.Errorf("bad status: %s", resp.Status)
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return &OriginError{Code: "origin_not_found", Status: http.StatusNotFound, Err: err}
+	}
+
+	return &OriginError{Code: "origin_bad_status", Status: http.StatusBadGateway, Err: err}
+}
+
+func isTLSError(err error) bool {
+	var (
+		recordErr    tls.RecordHeaderError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &recordErr) || errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// maxRedirects is max number of redirects followed by download
+const maxRedirects = 10
+
+// allowedHostsKey is a context key of function, which checks hosts download is redirected to
+type allowedHostsKey struct{}
+
+// withAllowedHosts returns context, downloads bound to which follow redirects only to allowed hosts
+func withAllowedHosts(ctx context.Context, allowed func(host string) bool) context.Context {
+	return context.WithValue(ctx, allowedHostsKey{}, allowed)
+}
+
+// originClient is a client for downloads, it checks every redirect against allowed hosts of request context
+var originClient = &http.Client{CheckRedirect: checkRedirect}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	allowed, ok := req.Context().Value(allowedHostsKey{}).(func(host string) bool)
+	if ok && !allowed(req.URL.Hostname()) {
+		return errors.Wrapf(errRedirectNotAllowed, "redirect to %s", req.URL.Host)
+	}
+
+	return nil
+}
+
 // Downloader is an interface that works with
+// errors of requests to origin are returned as *OriginError
 type Downloader interface {
-	DownloadFile(URL string) (io.ReadCloser, error)
-	StoreFileToTemp(URL string) (string, error)
+	DownloadFile(ctx context.Context, URL string) (io.ReadCloser, error)
+	StoreFileToTemp(ctx context.Context, URL string) (string, error)
 }
 
 // Downloader is a type to process downloads
@@ -24,43 +125,52 @@ func NewDownloader() Downloader {
 }
 
 // StoreFileToTemp saves file content to temporary file and returns path
-func (d *Downloads) StoreFileToTemp(URL string) (string, error) {
-	content, err := d.DownloadFile(URL)
+// download is aborted and temp file removed as soon as ctx is done
+func (d *Downloads) StoreFileToTemp(ctx context.Context, URL string) (string, error) {
+	content, err := d.DownloadFile(ctx, URL)
 	if err != nil {
 		return "", err
 	}
+	defer content.Close()
 
 	tempFile, err := ioutil.TempFile("", "")
 	if err != nil {
 		return "", err
 	}
+	defer tempFile.Close()
 
 	_, err = io.Copy(tempFile, content)
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
-		return "", err
+		os.Remove(tempFile.Name())
+		return "", newOriginError(errors.Wrap(err, "store downloaded file"))
 	}
-	content.Close()
 
 	return tempFile.Name(), nil
 }
 
 // DownloadFile downloads file by URL and returns content
-func (d *Downloads) DownloadFile(URL string) (io.ReadCloser, error) {
+// request is bound to ctx, so cancellation closes connection to origin
+func (d *Downloads) DownloadFile(ctx context.Context, URL string) (io.ReadCloser, error) {
 	req, err := http.NewRequest("GET", URL, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "create request object")
 	}
 
+	req = req.WithContext(ctx)
 	req.Close = true
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := originClient.Do(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "download file by URL")
+		return nil, newOriginError(errors.Wrap(err, "download file by URL"))
 	}
 
 	// Check server response
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status: %s", resp.Status)
+		resp.Body.Close()
+		return nil, newOriginStatusError(resp)
 	}
 
 	return resp.Body, nil
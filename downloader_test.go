@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloaderErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.jpg":
+			w.WriteHeader(http.StatusNotFound)
+		case "/slow.jpg":
+			time.Sleep(100 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+
+	// only slow origin gets deadline shorter than its response time
+	cases := []struct {
+		name    string
+		url     string
+		timeout time.Duration
+		code    string
+		status  int
+	}{
+		{"not found", ts.URL + "/missing.jpg", 10 * time.Second, "origin_not_found", http.StatusNotFound},
+		{"bad status", ts.URL + "/broken.jpg", 10 * time.Second, "origin_bad_status", http.StatusBadGateway},
+		{"timeout", ts.URL + "/slow.jpg", 50 * time.Millisecond, "origin_timeout", http.StatusGatewayTimeout},
+		{"tls", tlsServer.URL + "/image.jpg", 10 * time.Second, "origin_tls_error", http.StatusBadGateway},
+		{"unreachable", "http://127.0.0.1:1/image.jpg", 10 * time.Second, "origin_unreachable", http.StatusBadGateway},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+
+			_, err := NewDownloader().StoreFileToTemp(ctx, tc.url)
+			require.Error(t, err)
+
+			var originErr *OriginError
+			require.True(t, errors.As(err, &originErr))
+			assert.Equal(t, tc.code, originErr.Code)
+			assert.Equal(t, tc.status, originErr.Status)
+		})
+	}
+}
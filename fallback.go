@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// fallbackHeader tells client that fallback image is returned, its value is a code of error
+const fallbackHeader = "X-Image-Fallback"
+
+// respondWithFallback responds with fallback image of requested size instead of error
+// fallback image goes through the same resize pipeline and cache as other images
+// error response is returned if there is no fallback for image origin, request context is done or fallback fails
+func (fx *ImageFixture) respondWithFallback(w http.ResponseWriter, r *http.Request, c Cache, s *Settings, i Imager, status int, cause error) (int, error) {
+	fb, ok := s.FallbackImage(fx.Params.URL)
+	if !ok || r.Context().Err() != nil {
+		return fx.respondWithError(w, status, cause)
+	}
+
+	// fallback is resized with all params of request, only image and its cache key differ
+	ffx := NewImageFixture()
+	ffx.RequestID = fx.RequestID
+	ffx.Head = fx.Head
+	ffx.Params = fx.Params
+	ffx.SetParams("fallback:"+fb.Image, fx.Params.Width, fx.Params.Height)
+
+	buffer, err := ffx.fallback(r, c, i, fb.Image)
+	if err != nil {
+		fx.respondWithError(w, status, cause)
+		return status, errors.Wrapf(cause, "serve fallback image: %v", err)
+	}
+
+	w.Header().Set(fallbackHeader, newErrorBody(status, cause).Code)
+	if buffer == nil {
+		ffx.respondWithRedirect(w, fb.CachePolicy())
+		return http.StatusNotModified, errors.Wrap(cause, "served fallback image")
+	}
+
+	ffx.respondWithImage(w, buffer, fb.CachePolicy())
+	return http.StatusOK, errors.Wrap(cause, "served fallback image")
+}
+
+// fallback returns resized fallback image from cache or resizes it
+// nil buffer is returned if client has up to date image
+func (fx *ImageFixture) fallback(r *http.Request, c Cache, i Imager, image string) (*bytes.Buffer, error) {
+	ctx := r.Context()
+
+	b, header, ok := c.GetVariant(fx.File.Key, fx.variant())
+	if ok {
+		fx.setVariantHeader(header, b)
+		if fx.upToDate(r) {
+			return nil, nil
+		}
+
+		return bytes.NewBuffer(b), nil
+	}
+
+	path, ok := c.GetOriginal(fx.File.Key)
+	if !ok {
+		// cache takes ownership of original, so it gets a copy of fallback image
+		tmp, err := ioutil.TempFile("", "")
+		if err != nil {
+			return nil, err
+		}
+		tmp.Close()
+
+		err = copyFile(image, tmp.Name())
+		if err != nil {
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+
+		path, err = c.SetOriginal(fx.File.Key, tmp.Name())
+		if err != nil {
+			return nil, err
+		}
+	}
+	fx.File.Path = path
+
+	_, err := fx.decode(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer, _, err := fx.resize(ctx, c, i)
+	return buffer, err
+}
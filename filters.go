@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Filter is an adjustment of resized image, requested as <name>=<value>
+type Filter struct {
+	Name  string
+	Value float64
+}
+
+// filterRange is a range of allowed filter values
+type filterRange struct {
+	min, max float64
+}
+
+// filterNames are names of supported filters in order of their application
+// color adjustments go first, blur and sharpening are applied to adjusted colors
+var filterNames = []string{"grayscale", "sepia", "brightness", "contrast", "gamma", "saturation", "blur", "sharpen"}
+
+// filterRanges contains allowed values of filters
+// grayscale and sepia values are strength of effect, 1 is full effect
+// brightness, contrast and saturation values are percents of change
+// blur value is a sigma of Gaussian blur, sharpen value is an amount of unsharp mask
+var filterRanges = map[string]filterRange{
+	"grayscale":  {0, 1},
+	"sepia":      {0, 1},
+	"brightness": {-100, 100},
+	"contrast":   {-100, 100},
+	"gamma":      {0.1, 10},
+	"saturation": {-100, 100},
+	"blur":       {0.1, 50},
+	"sharpen":    {0.1, 10},
+}
+
+// parseFilters reads filters from request params, filters are returned in order of application
+func parseFilters(form url.Values) ([]Filter, error) {
+	var filters []Filter
+	for _, name := range filterNames {
+		value := form.Get(name)
+		if len(value) == 0 {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(value, 64)
+		limits := filterRanges[name]
+		if err != nil || v < limits.min || v > limits.max {
+			return nil, newRequestError("invalid_filter", fmt.Errorf("%s has to be in range [%g, %g], got %q", name, limits.min, limits.max, value))
+		}
+
+		filters = append(filters, Filter{Name: name, Value: v})
+	}
+
+	return filters, nil
+}
+
+// filtersName returns part of variant name with filters, e.g. "blur=2,grayscale=1"
+func filtersName(filters []Filter) string {
+	parts := make([]string, 0, len(filters))
+	for _, f := range filters {
+		parts = append(parts, f.Name+"="+strconv.FormatFloat(f.Value, 'g', -1, 64))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// applyFilter returns copy of image with filter applied
+func applyFilter(img image.Image, name string, value float64) (*image.NRGBA, error) {
+	src := toNRGBA(img)
+
+	switch name {
+	case "grayscale":
+		return mixColors(src, value, func(r, g, b float64) (float64, float64, float64) {
+			y := luma(r, g, b)
+			return y, y, y
+		}), nil
+	case "sepia":
+		return mixColors(src, value, func(r, g, b float64) (float64, float64, float64) {
+			return 0.393*r + 0.769*g + 0.189*b, 0.349*r + 0.686*g + 0.168*b, 0.272*r + 0.534*g + 0.131*b
+		}), nil
+	case "brightness":
+		shift := value / 100 * 255
+		return mapChannels(src, func(v float64) float64 { return v + shift }), nil
+	case "contrast":
+		factor := 1 + value/100
+		return mapChannels(src, func(v float64) float64 { return (v/255-0.5)*factor*255 + 127.5 }), nil
+	case "gamma":
+		return mapChannels(src, func(v float64) float64 { return 255 * math.Pow(v/255, 1/value) }), nil
+	case "saturation":
+		factor := 1 + value/100
+		return mixColors(src, 1, func(r, g, b float64) (float64, float64, float64) {
+			y := luma(r, g, b)
+			return y + (r-y)*factor, y + (g-y)*factor, y + (b-y)*factor
+		}), nil
+	case "blur":
+		return gaussianBlur(src, value), nil
+	case "sharpen":
+		return unsharpMask(src, 1, value), nil
+	}
+
+	return nil, fmt.Errorf("unknown filter %s", name)
+}
+
+// toNRGBA converts image to NRGBA image with bounds starting at zero point
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	return dst
+}
+
+func luma(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+func clampChannel(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// mapChannels returns copy of image with function applied to every color channel, alpha is kept
+// function is computed once per channel value
+func mapChannels(src *image.NRGBA, f func(v float64) float64) *image.NRGBA {
+	var table [256]uint8
+	for v := range table {
+		table[v] = clampChannel(f(float64(v)))
+	}
+
+	dst := image.NewNRGBA(src.Rect)
+	for n := 0; n < len(src.Pix); n += 4 {
+		dst.Pix[n] = table[src.Pix[n]]
+		dst.Pix[n+1] = table[src.Pix[n+1]]
+		dst.Pix[n+2] = table[src.Pix[n+2]]
+		dst.Pix[n+3] = src.Pix[n+3]
+	}
+
+	return dst
+}
+
+// mixColors returns copy of image with color function applied to every pixel
+// result is mixed with original color by strength from 0 to 1, alpha is kept
+func mixColors(src *image.NRGBA, strength float64, f func(r, g, b float64) (float64, float64, float64)) *image.NRGBA {
+	dst := image.NewNRGBA(src.Rect)
+	for n := 0; n < len(src.Pix); n += 4 {
+		r, g, b := float64(src.Pix[n]), float64(src.Pix[n+1]), float64(src.Pix[n+2])
+		fr, fg, fb := f(r, g, b)
+
+		dst.Pix[n] = clampChannel(r + (fr-r)*strength)
+		dst.Pix[n+1] = clampChannel(g + (fg-g)*strength)
+		dst.Pix[n+2] = clampChannel(b + (fb-b)*strength)
+		dst.Pix[n+3] = src.Pix[n+3]
+	}
+
+	return dst
+}
+
+// gaussianKernel returns normalized one-dimensional Gaussian kernel of radius 3*sigma
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+
+	sum := 0.0
+	for n := range kernel {
+		x := float64(n - radius)
+		kernel[n] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[n]
+	}
+	for n := range kernel {
+		kernel[n] /= sum
+	}
+
+	return kernel
+}
+
+// gaussianBlur blurs image with separable Gaussian filter, pixels outside of image repeat edge pixels
+func gaussianBlur(src *image.NRGBA, sigma float64) *image.NRGBA {
+	kernel := gaussianKernel(sigma)
+	return convolve(convolve(src, kernel, 1, 0), kernel, 0, 1)
+}
+
+// convolve applies one-dimensional kernel to image along direction dx, dy
+// channels are premultiplied by alpha, so transparent pixels do not bleed their color
+func convolve(src *image.NRGBA, kernel []float64, dx, dy int) *image.NRGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	radius := len(kernel) / 2
+	dst := image.NewNRGBA(src.Rect)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a float64
+			for k, weight := range kernel {
+				sx := clampInt(x+(k-radius)*dx, 0, width-1)
+				sy := clampInt(y+(k-radius)*dy, 0, height-1)
+
+				p := src.Pix[sy*src.Stride+sx*4:]
+				pa := float64(p[3]) / 255
+				r += weight * float64(p[0]) * pa
+				g += weight * float64(p[1]) * pa
+				b += weight * float64(p[2]) * pa
+				a += weight * pa
+			}
+
+			p := dst.Pix[y*dst.Stride+x*4:]
+			if a > 0 {
+				p[0], p[1], p[2] = clampChannel(r/a), clampChannel(g/a), clampChannel(b/a)
+			}
+			p[3] = clampChannel(a * 255)
+		}
+	}
+
+	return dst
+}
+
+// unsharpMask sharpens image by adding difference between image and its blurred copy
+func unsharpMask(src *image.NRGBA, sigma, amount float64) *image.NRGBA {
+	blurred := gaussianBlur(src, sigma)
+
+	dst := image.NewNRGBA(src.Rect)
+	for n := 0; n < len(src.Pix); n += 4 {
+		for c := 0; c < 3; c++ {
+			v := float64(src.Pix[n+c])
+			dst.Pix[n+c] = clampChannel(v + (v-float64(blurred.Pix[n+c]))*amount)
+		}
+		dst.Pix[n+3] = src.Pix[n+3]
+	}
+
+	return dst
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+
+	return v
+}
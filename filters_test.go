@@ -0,0 +1,74 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFilters(t *testing.T) {
+	filters, err := parseFilters(url.Values{"sharpen": {"1.5"}, "blur": {"2"}, "grayscale": {"1"}, "width": {"100"}})
+	require.NoError(t, err)
+	assert.Equal(t, []Filter{{"grayscale", 1}, {"blur", 2}, {"sharpen", 1.5}}, filters)
+	assert.Equal(t, "grayscale=1,blur=2,sharpen=1.5", filtersName(filters))
+
+	for _, form := range []url.Values{{"blur": {"0"}}, {"gamma": {"abc"}}, {"brightness": {"101"}}} {
+		_, err = parseFilters(form)
+		assert.Error(t, err)
+	}
+}
+
+func TestApplyFilter(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{200, 100, 50, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 0, 255})
+	img.SetNRGBA(2, 0, color.NRGBA{255, 255, 255, 128})
+
+	cases := []struct {
+		name     string
+		value    float64
+		expected []color.NRGBA
+	}{
+		{"grayscale", 1, []color.NRGBA{{124, 124, 124, 255}, {0, 0, 0, 255}, {255, 255, 255, 128}}},
+		{"grayscale", 0.5, []color.NRGBA{{162, 112, 87, 255}, {0, 0, 0, 255}, {255, 255, 255, 128}}},
+		{"sepia", 1, []color.NRGBA{{165, 147, 114, 255}, {0, 0, 0, 255}, {255, 255, 239, 128}}},
+		{"brightness", 10, []color.NRGBA{{226, 126, 76, 255}, {26, 26, 26, 255}, {255, 255, 255, 128}}},
+		{"contrast", -100, []color.NRGBA{{128, 128, 128, 255}, {128, 128, 128, 255}, {128, 128, 128, 128}}},
+		{"gamma", 1, []color.NRGBA{{200, 100, 50, 255}, {0, 0, 0, 255}, {255, 255, 255, 128}}},
+		{"saturation", -100, []color.NRGBA{{124, 124, 124, 255}, {0, 0, 0, 255}, {255, 255, 255, 128}}},
+	}
+
+	for _, tc := range cases {
+		filtered, err := applyFilter(img, tc.name, tc.value)
+		require.NoError(t, err)
+
+		for x, expected := range tc.expected {
+			assert.Equal(t, expected, filtered.NRGBAAt(x, 0), "%s=%g at %d", tc.name, tc.value, x)
+		}
+	}
+
+	_, err := applyFilter(img, "emboss", 1)
+	assert.Error(t, err)
+}
+
+func TestGaussianBlur(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 9, 9))
+	for n := range img.Pix {
+		img.Pix[n] = 255
+	}
+	img.SetNRGBA(4, 4, color.NRGBA{0, 0, 0, 255})
+
+	blurred := gaussianBlur(img, 1)
+	center, near, far := blurred.NRGBAAt(4, 4), blurred.NRGBAAt(5, 4), blurred.NRGBAAt(0, 0)
+
+	// dark dot is spread to neighbours, far pixels are untouched
+	assert.True(t, center.R > 0 && center.R < near.R && near.R < 255)
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, far)
+
+	sharpened := unsharpMask(blurred, 1, 2)
+	assert.True(t, sharpened.NRGBAAt(4, 4).R < center.R)
+}
@@ -2,38 +2,160 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"image"
+	"image/color"
+	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 // ImageFixture is a helpful tool for resize handler operations
 type ImageFixture struct {
+	RequestID string
+	// Head is set for HEAD requests, response gets headers of image without body
+	Head   bool
 	Params struct {
-		URL    string
-		Width  uint64
-		Height uint64
+		URL     string
+		Width   uint64
+		Height  uint64
+		Preset  string
+		DPR     float64
+		Sharpen float64
+		Filters []Filter
+		Caption *Caption
+		// Format is a format of resized image, Background fills padding and transparent areas of JPEG image
+		Format     string
+		Background color.NRGBA
+		Pad        int
+		// Mask cuts resized image by circle or rounded corners of Radius, Border is drawn along edge of mask
+		Mask        string
+		Radius      int
+		Border      int
+		BorderColor color.NRGBA
+		// Watermark is drawn over resized image, WatermarkName identifies it in variant name
+		// Overlay is URL of downloaded watermark
+		Watermark     *Watermark
+		WatermarkName string
+		Overlay       string
+		// Frame is a number of frame of animated image to be resized, all frames are resized if it is negative
+		Frame int
 	}
 	File struct {
-		ContentType string
-		Path        string
-		Etag        string
-		Handler     *os.File
+		ContentType  string
+		Path         string
+		Key          string
+		Etag         string
+		LastModified time.Time
+		Handler      *os.File
+		// Animated is set if all frames of animated image are resized
+		Animated bool
+		// size of original image
+		Width  int
+		Height int
 	}
 }
 
-// NewImageFixture returns new ImageFixture object
+// NewImageFixture returns new ImageFixture object with default format, background and border color of resized image
+// all frames of animated image are resized by default
 func NewImageFixture() *ImageFixture {
-	return &ImageFixture{}
+	fx := &ImageFixture{}
+	fx.Params.Format, fx.Params.Background = defaultFormat, defaultBackground
+	fx.Params.BorderColor = defaultBorderColor
+	fx.Params.Frame = -1
+
+	return fx
 }
 
+// SetParams sets request params and cache key of image, which is MD5 of URL
 func (fx *ImageFixture) SetParams(u string, w, h uint64) {
 	fx.Params.URL, fx.Params.Width, fx.Params.Height = u, w, h
+	fx.File.Key = keyOf(u)
+}
 
+// keyOf returns cache key of image URL, which is MD5 of URL
+func keyOf(u string) string {
 	hasher := md5.New()
-	hasher.Write([]byte(fx.Params.URL))
-	fx.File.Etag = hex.EncodeToString(hasher.Sum(nil))
+	hasher.Write([]byte(u))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// SetEtag sets strong ETag computed from content of resized image
+func (fx *ImageFixture) SetEtag(content []byte) {
+	sum := sha256.Sum256(content)
+	fx.File.Etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// variant returns name of requested resized image in cache
+// sharpening after downscale, filters, caption, watermark, mask and output params are part of name,
+// e.g. "100x100:autosharpen=0.5,blur=2,format=png"
+// size scaled by device pixel ratio is limited by size of original, so ratio above 1 is a part of name too
+func (fx *ImageFixture) variant() string {
+	name := variantName(fx.Params.Width, fx.Params.Height)
+
+	var parts []string
+	if fx.Params.DPR > 1 {
+		parts = append(parts, "dpr="+strconv.FormatFloat(fx.Params.DPR, 'g', -1, 64))
+	}
+	if fx.Params.Sharpen > 0 {
+		parts = append(parts, "autosharpen="+strconv.FormatFloat(fx.Params.Sharpen, 'g', -1, 64))
+	}
+	if len(fx.Params.Filters) > 0 {
+		parts = append(parts, filtersName(fx.Params.Filters))
+	}
+	if fx.Params.Caption != nil {
+		parts = append(parts, fx.textName())
+	}
+	if fx.Params.Watermark != nil {
+		parts = append(parts, fx.watermarkName())
+	}
+	parts = append(parts, fx.maskName()...)
+	parts = append(parts, fx.outputName()...)
+	if len(parts) > 0 {
+		name += ":" + strings.Join(parts, ",")
+	}
+
+	return name
+}
+
+// variantHeader returns headers stored in cache along with resized image
+func (fx *ImageFixture) variantHeader() http.Header {
+	return http.Header{
+		"Etag":          {fx.File.Etag},
+		"Last-Modified": {fx.File.LastModified.UTC().Format(http.TimeFormat)},
+		"Content-Type":  {fx.contentType()},
+	}
+}
+
+// setVariantHeader restores ETag and Last-Modified of resized image from cache
+// ETag is computed from content if cache does not have one
+func (fx *ImageFixture) setVariantHeader(header http.Header, content []byte) {
+	fx.File.Etag = header.Get("Etag")
+	if len(fx.File.Etag) == 0 {
+		fx.SetEtag(content)
+	}
+
+	fx.File.LastModified, _ = http.ParseTime(header.Get("Last-Modified"))
+	fx.File.Animated = header.Get("Content-Type") == outputFormats["gif"]
+}
+
+// readOriginalSize reads size of original image from its header
+func (fx *ImageFixture) readOriginalSize() error {
+	config, _, err := image.DecodeConfig(fx.File.Handler)
+	if err != nil {
+		return newRequestError("unsupported_format", errors.Wrap(err, "read image size"))
+	}
+	fx.File.Width, fx.File.Height = config.Width, config.Height
+
+	_, err = fx.File.Handler.Seek(0, io.SeekStart)
+	return err
 }
 
 func (fx *ImageFixture) checkFileContentType(allowed map[string]bool) error {
@@ -52,7 +174,7 @@ func (fx *ImageFixture) checkFileContentType(allowed map[string]bool) error {
 	fx.File.ContentType = http.DetectContentType(buffer)
 
 	if _, ok := allowed[fx.File.ContentType]; !ok {
-		return fmt.Errorf("%s image format is not allowed", fx.File.ContentType)
+		return newRequestError("unsupported_format", fmt.Errorf("%s image format is not allowed", fx.File.ContentType))
 	}
 
 	return nil
@@ -1,25 +1,40 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 
 	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
 )
 
 // Imager is an interface that works with images
+// operations after Resize are applied to every frame of animated image
 type Imager interface {
 	Open(path string) (*os.File, error)
-	Decode(reader io.Reader) error
-	Encode() (*bytes.Buffer, error)
-	EncodeToWriter(writer io.Writer) error
-	Resize(width, height uint)
-	StoreResizedToTempFile() (string, error)
+	Decode(ctx context.Context, reader io.Reader) error
+	Frames() int
+	Frame(n int) error
+	Encode(ctx context.Context, format string, bg color.NRGBA) (*bytes.Buffer, error)
+	EncodeToWriter(ctx context.Context, writer io.Writer, format string, bg color.NRGBA) error
+	Resize(ctx context.Context, width, height uint, sharpen float64) error
+	Filter(ctx context.Context, name string, value float64) error
+	Pad(ctx context.Context, pad int, bg color.NRGBA) error
+	Text(ctx context.Context, text string, size float64, fg, bg color.NRGBA, position string) error
+	Overlay(ctx context.Context, path, position string, margin int, opacity, scale float64) error
+	Mask(ctx context.Context, mask string, radius, border int, borderColor color.NRGBA) error
 }
 
 // NewImager returns new Images object
@@ -28,10 +43,15 @@ func NewImager() Imager {
 }
 
 // Imager contains original and resized image objects for request
-// Imager can encode/decode and resize JPEG pictures
+// Imager can decode JPEG, PNG and GIF pictures, resize them and encode them to JPEG, PNG or GIF
+// animation is decoded animated GIF, frames are its frames composed to full size images
+// resizedFrames are frames after resize, resized image is the first of them
 type Images struct {
-	original image.Image
-	resized  image.Image
+	original      image.Image
+	resized       image.Image
+	animation     *gif.GIF
+	frames        []image.Image
+	resizedFrames []image.Image
 }
 
 // Open returns file handler and error
@@ -39,44 +59,268 @@ func (i *Images) Open(path string) (*os.File, error) {
 	return os.Open(path)
 }
 
-// Decode JPEG image to io.Reader
-func (i *Images) Decode(reader io.Reader) error {
-	var err error
-	i.original, err = jpeg.Decode(reader)
-	return err
+// Decode JPEG, PNG or GIF image from io.Reader
+// all frames of animated GIF are decoded, first frame is used as original image
+// GIF, frames of which do not fit maxAnimationPixels, is rejected with RequestError
+func (i *Images) Decode(ctx context.Context, reader io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	i.animation, i.frames, i.resizedFrames = nil, nil, nil
+
+	buffered := bufio.NewReader(reader)
+	if header, err := buffered.Peek(len(gifHeader)); err != nil || string(header) != gifHeader {
+		var err error
+		i.original, _, err = image.Decode(buffered)
+		return err
+	}
+
+	// GIF is read twice: its size is checked before frames are decoded
+	data, err := ioutil.ReadAll(buffered)
+	if err != nil {
+		return err
+	}
+	if err = checkAnimationSize(data); err != nil {
+		return err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	frames := composeFrames(g)
+	if len(frames) == 0 {
+		return fmt.Errorf("gif has no frames")
+	}
+
+	i.original = frames[0]
+	if len(frames) > 1 {
+		i.animation, i.frames = g, frames
+	}
+
+	return nil
 }
 
-// Encode JPEG image into new bytes buffer
-func (i *Images) Encode() (*bytes.Buffer, error) {
+// Frames returns number of frames of decoded image
+func (i *Images) Frames() int {
+	if i.animation == nil {
+		return 1
+	}
+
+	return len(i.frames)
+}
+
+// Frame makes still image of frame n of decoded image, animation is dropped
+func (i *Images) Frame(n int) error {
+	if n < 0 || n >= i.Frames() {
+		return newRequestError("invalid_frame", fmt.Errorf("image has %d frames, frame %d requested", i.Frames(), n))
+	}
+
+	if i.animation != nil {
+		i.original = i.frames[n]
+		i.animation, i.frames = nil, nil
+	}
+
+	return nil
+}
+
+// Encode image of format into new bytes buffer
+func (i *Images) Encode(ctx context.Context, format string, bg color.NRGBA) (*bytes.Buffer, error) {
 	buffer := new(bytes.Buffer)
-	err := jpeg.Encode(buffer, i.resized, &jpeg.Options{Quality: jpeg.DefaultQuality})
+	err := i.EncodeToWriter(ctx, buffer, format, bg)
 	return buffer, err
 }
 
-// EncodeToWriter encodes JPEG image to io.Writer
-func (i *Images) EncodeToWriter(writer io.Writer) error {
-	return jpeg.Encode(writer, i.resized, &jpeg.Options{Quality: jpeg.DefaultQuality})
+// EncodeToWriter encodes image of format to io.Writer, see outputFormats for supported formats
+// transparent areas are flattened onto background color for formats without alpha channel
+// all frames of animation are encoded to GIF, other formats get the first frame
+// encoding is skipped if ctx is already done
+func (i *Images) EncodeToWriter(ctx context.Context, writer io.Writer, format string, bg color.NRGBA) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	img := i.resized
+	if !alphaFormats[format] {
+		img = flatten(img, bg)
+	}
+
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(writer, img, &jpeg.Options{Quality: jpeg.DefaultQuality})
+	case "png":
+		return png.Encode(writer, img)
+	case "gif":
+		if len(i.resizedFrames) > 0 {
+			return encodeGIF(writer, i.resizedFrames, i.animation.Delay, i.animation.LoopCount, gifPalettes(i.animation))
+		}
+		return encodeGIF(writer, []image.Image{img}, []int{0}, 0, []color.Palette{withTransparent(palette.Plan9)})
+	}
+
+	return fmt.Errorf("unknown format %s", format)
+}
+
+// Resize image with provided width and height, every frame of animation is resized
+// downscaled image is sharpened with unsharp mask of sharpen amount, zero amount disables sharpening
+// context is checked before every frame, so resize of animation is aborted when request is done
+func (i *Images) Resize(ctx context.Context, width, height uint, sharpen float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	i.resizedFrames = nil
+	for _, frame := range i.frames {
+		if err := ctx.Err(); err != nil {
+			i.resizedFrames = nil
+			return err
+		}
+		i.resizedFrames = append(i.resizedFrames, resizeImage(frame, width, height, sharpen))
+	}
+
+	if len(i.resizedFrames) > 0 {
+		i.resized = i.resizedFrames[0]
+	} else {
+		i.resized = resizeImage(i.original, width, height, sharpen)
+	}
+
+	return nil
+}
+
+// resizeImage resizes image and sharpens downscaled result
+func resizeImage(img image.Image, width, height uint, sharpen float64) image.Image {
+	resized := resize.Resize(width, height, img, resize.Lanczos3)
+
+	if amount := sharpenAmount(img.Bounds(), resized.Bounds(), sharpen); amount > 0 {
+		return unsharpMask(toNRGBA(resized), sharpenSigma, amount)
+	}
+
+	return resized
 }
 
-// Resize image with provided width and height
-func (i *Images) Resize(width, height uint) {
-	i.resized = resize.Resize(width, height, i.original, resize.Lanczos3)
+// transform applies function to resized image and to every resized frame of animation
+// context is checked before every frame, so transformation of animation is aborted when request is done
+func (i *Images) transform(ctx context.Context, f func(img image.Image) (image.Image, error)) error {
+	if i.resized == nil {
+		return fmt.Errorf("no resized image yet")
+	}
+
+	if len(i.resizedFrames) == 0 {
+		img, err := f(i.resized)
+		if err != nil {
+			return err
+		}
+
+		i.resized = img
+		return nil
+	}
+
+	for n, frame := range i.resizedFrames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		img, err := f(frame)
+		if err != nil {
+			return err
+		}
+
+		i.resizedFrames[n] = img
+	}
+	i.resized = i.resizedFrames[0]
+
+	return nil
 }
 
-// StoreResizedToTempFile stores resized image into temporary file and returns path
-func (i *Images) StoreResizedToTempFile() (string, error) {
+// sharpenSigma is a sigma of unsharp mask applied after downscale
+// it is small, so only fine details lost by resampling are restored
+const sharpenSigma = 0.6
+
+// sharpenFullRatio is a reduction ratio, from which sharpen amount is applied in full
+const sharpenFullRatio = 4
+
+// sharpenAmount scales sharpen amount by reduction ratio of image
+// enlarged image is not sharpened, amount grows with logarithm of ratio up to full amount
+func sharpenAmount(original, resized image.Rectangle, sharpen float64) float64 {
+	if sharpen <= 0 || resized.Dx() == 0 || resized.Dy() == 0 {
+		return 0
+	}
+
+	ratio := math.Max(float64(original.Dx())/float64(resized.Dx()), float64(original.Dy())/float64(resized.Dy()))
+	if ratio <= 1 {
+		return 0
+	}
+
+	return sharpen * math.Min(1, math.Log(ratio)/math.Log(sharpenFullRatio))
+}
+
+// Filter applies filter with value to resized image, see filterNames for supported filters
+func (i *Images) Filter(ctx context.Context, name string, value float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.transform(ctx, func(img image.Image) (image.Image, error) {
+		return applyFilter(img, name, value)
+	})
+}
+
+// Pad adds padding of background color around resized image
+func (i *Images) Pad(ctx context.Context, pad int, bg color.NRGBA) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.transform(ctx, func(img image.Image) (image.Image, error) {
+		return padImage(img, pad, bg), nil
+	})
+}
+
+// Text draws caption over resized image with bundled font, see drawText for params
+func (i *Images) Text(ctx context.Context, text string, size float64, fg, bg color.NRGBA, position string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.transform(ctx, func(img image.Image) (image.Image, error) {
+		return drawText(img, text, size, fg, bg, position)
+	})
+}
+
+// Overlay draws watermark image from file over resized image, see overlayImage for params
+func (i *Images) Overlay(ctx context.Context, path, position string, margin int, opacity, scale float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if i.resized == nil {
-		return "", fmt.Errorf("no resized image yet")
+		return fmt.Errorf("no resized image yet")
 	}
 
-	file, err := ioutil.TempFile("", "")
+	file, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer file.Close()
+
+	watermark, _, err := image.Decode(file)
+	if err != nil {
+		return errors.Wrap(err, "decode watermark")
+	}
+
+	return i.transform(ctx, func(img image.Image) (image.Image, error) {
+		return overlayImage(img, watermark, position, margin, opacity, scale), nil
+	})
+}
 
-	if err = i.EncodeToWriter(file); err != nil {
-		return "", err
+// Mask cuts resized image by mask and draws border along its edge, see maskImage for params
+func (i *Images) Mask(ctx context.Context, mask string, radius, border int, borderColor color.NRGBA) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	return file.Name(), nil
+	return i.transform(ctx, func(img image.Image) (image.Image, error) {
+		return maskImage(img, mask, radius, border, borderColor), nil
+	})
 }
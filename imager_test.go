@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// update rewrites golden images in testdata with current output, run as go test -run Golden -update
+var update = flag.Bool("update", false, "update golden images in testdata")
+
+// goldenTolerance is max difference of color channel, so golden images survive small changes of rounding
+const goldenTolerance = 2
+
+func TestImagesResizeGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		width   uint
+		height  uint
+		sharpen float64
+		golden  string
+	}{
+		{"no sharpening", 100, 0, 0, "testdata/gopher.100.png"},
+		{"sharpening", 100, 0, 1, "testdata/gopher.100.sharpen.png"},
+		{"weak reduction", 300, 0, 1, "testdata/gopher.300.sharpen.png"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i := decodeTestImage(t, "testdata/gopher.original.jpg")
+			require.NoError(t, i.Resize(context.Background(), tc.width, tc.height, tc.sharpen))
+
+			if *update {
+				f, err := os.Create(tc.golden)
+				require.NoError(t, err)
+				require.NoError(t, png.Encode(f, i.resized))
+				require.NoError(t, f.Close())
+			}
+
+			f, err := os.Open(tc.golden)
+			require.NoError(t, err)
+			defer f.Close()
+
+			golden, err := png.Decode(f)
+			require.NoError(t, err)
+			assertImagesEqual(t, golden, i.resized)
+		})
+	}
+	t.Run("sharpening changes image", func(t *testing.T) {
+		plain := decodeTestImage(t, "testdata/gopher.original.jpg")
+		require.NoError(t, plain.Resize(context.Background(), 100, 0, 0))
+
+		sharpened := decodeTestImage(t, "testdata/gopher.original.jpg")
+		require.NoError(t, sharpened.Resize(context.Background(), 100, 0, 1))
+
+		assert.NotEqual(t, toNRGBA(plain.resized).Pix, toNRGBA(sharpened.resized).Pix)
+	})
+}
+
+func TestSharpenAmount(t *testing.T) {
+	original := image.Rect(0, 0, 400, 300)
+
+	assert.Equal(t, 0.0, sharpenAmount(original, image.Rect(0, 0, 100, 75), 0))
+	assert.Equal(t, 0.0, sharpenAmount(original, image.Rect(0, 0, 400, 300), 1))
+	assert.Equal(t, 0.0, sharpenAmount(original, image.Rect(0, 0, 800, 600), 1))
+	assert.InDelta(t, 0.5, sharpenAmount(original, image.Rect(0, 0, 200, 150), 1), 1e-9)
+	assert.InDelta(t, 1.0, sharpenAmount(original, image.Rect(0, 0, 100, 75), 1), 1e-9)
+	assert.InDelta(t, 2.0, sharpenAmount(original, image.Rect(0, 0, 40, 30), 2), 1e-9)
+}
+
+// decodeTestImage returns Images object with decoded original image
+func decodeTestImage(t *testing.T, path string) *Images {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	i := &Images{}
+	require.NoError(t, i.Decode(context.Background(), f))
+
+	return i
+}
+
+// assertImagesEqual checks that images have the same size and colors within golden tolerance
+func assertImagesEqual(t *testing.T, expected, actual image.Image) {
+	e, a := toNRGBA(expected), toNRGBA(actual)
+	require.Equal(t, e.Rect, a.Rect)
+
+	for n := range e.Pix {
+		diff := int(e.Pix[n]) - int(a.Pix[n])
+		if diff < -goldenTolerance || diff > goldenTolerance {
+			x, y := n%e.Stride/4, n/e.Stride
+			t.Fatalf("pixel (%d, %d) differs from golden image: expected %v, got %v", x, y, e.At(x, y), a.At(x, y))
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	_ "image/gif" // register formats for probe
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ImageInfo describes original image
+// orientation is a value of EXIF orientation tag, 1 means no rotation
+type ImageInfo struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Format      string `json:"format"`
+	Size        int64  `json:"size"`
+	Orientation int    `json:"orientation"`
+	ColorModel  string `json:"color_model"`
+	HasAlpha    bool   `json:"has_alpha"`
+}
+
+// infoHandler is a struct to serve info handler
+type infoHandler struct {
+	cache      Cache
+	settings   *Settings
+	timeout    time.Duration
+	downloader Downloader
+	logger     *log.Logger
+}
+
+// ServeHTTP passes request to InfoHandler and logs results
+func (ih *infoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ih.timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), ih.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	requestID := setRequestID(w, r)
+
+	status, err := InfoHandler(w, r, ih.cache, ih.settings, ih.downloader)
+	if err != nil {
+		ih.logger.SetPrefix("ERROR: ")
+		ih.logger.Println("request:", requestID, "| status:", status, "| ", err.Error())
+	} else {
+		ih.logger.SetPrefix("INFO: ")
+		ih.logger.Println("request:", requestID, "| status: ", status, "| probed image from "+strings.ToLower(r.Form.Get("url")))
+	}
+}
+
+// InfoHandler responds with JSON description of original image
+// original is downloaded once and shared with resize handler through cache
+func InfoHandler(w http.ResponseWriter, r *http.Request, c Cache, s *Settings, d Downloader) (int, error) {
+	ctx := r.Context()
+	fx := NewImageFixture()
+	fx.RequestID = r.Header.Get(requestIDHeader)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return fx.respondWithError(w, http.StatusMethodNotAllowed, newRequestError("method_not_allowed", errors.New("only GET and HEAD methods allowed")))
+	}
+	fx.Head = r.Method == http.MethodHead
+
+	r.ParseForm()
+	fx.SetParams(strings.ToLower(r.Form.Get("url")), 0, 0)
+	err := fx.validateUploadData()
+	if err != nil {
+		return fx.respondWithError(w, http.StatusBadRequest, err)
+	}
+
+	path, exists := c.GetOriginal(fx.File.Key)
+	if !exists {
+		path, err = d.StoreFileToTemp(ctx, fx.Params.URL)
+		if err != nil {
+			return fx.respondWithError(w, originErrorStatus(ctx, err), err)
+		}
+
+		path, err = c.SetOriginal(fx.File.Key, path)
+		if err != nil {
+			return fx.respondWithError(w, http.StatusInternalServerError, err)
+		}
+	}
+
+	info, err := probeImage(path)
+	if err != nil {
+		return fx.respondWithError(w, http.StatusBadRequest, err)
+	}
+
+	return fx.respondWithJSON(w, info, s.CachePolicy("", fx.Params.URL))
+}
+
+// probeImage reads size, format and color model of image without decoding all of it
+func probeImage(path string) (*ImageInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, newRequestError("unsupported_format", errors.Wrap(err, "probe image"))
+	}
+
+	info := &ImageInfo{
+		Width:       config.Width,
+		Height:      config.Height,
+		Format:      format,
+		Size:        stat.Size(),
+		Orientation: 1,
+		ColorModel:  colorModelName(config.ColorModel),
+		HasAlpha:    hasAlpha(config.ColorModel),
+	}
+
+	switch format {
+	case "jpeg":
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		info.Orientation = exifOrientation(file)
+	case "png":
+		// PNG decoder reports RGBA model for every truecolor image, color type tells real story
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		info.HasAlpha = pngAlpha(file)
+	}
+
+	return info, nil
+}
+
+// colorModelName returns name of standard color model
+func colorModelName(model color.Model) string {
+	switch model {
+	case color.YCbCrModel:
+		return "ycbcr"
+	case color.NYCbCrAModel:
+		return "nycbcra"
+	case color.CMYKModel:
+		return "cmyk"
+	case color.GrayModel:
+		return "gray"
+	case color.Gray16Model:
+		return "gray16"
+	case color.RGBAModel:
+		return "rgba"
+	case color.RGBA64Model:
+		return "rgba64"
+	case color.NRGBAModel:
+		return "nrgba"
+	case color.NRGBA64Model:
+		return "nrgba64"
+	case color.AlphaModel:
+		return "alpha"
+	case color.Alpha16Model:
+		return "alpha16"
+	}
+
+	if _, ok := model.(color.Palette); ok {
+		return "paletted"
+	}
+
+	return "unknown"
+}
+
+// hasAlpha checks if image of color model can be transparent
+// paletted image has alpha if any of palette colors is not opaque
+func hasAlpha(model color.Model) bool {
+	switch model {
+	case color.NYCbCrAModel, color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model,
+		color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+
+	if palette, ok := model.(color.Palette); ok {
+		for _, c := range palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// pngAlpha checks color type and transparency chunk of PNG image
+// image has alpha if it has alpha channel or tRNS chunk before image data
+func pngAlpha(r io.Reader) bool {
+	br := bufio.NewReader(r)
+
+	var signature [8]byte
+	if _, err := io.ReadFull(br, signature[:]); err != nil || string(signature[:]) != "\x89PNG\r\n\x1a\n" {
+		return false
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return false
+		}
+
+		length := binary.BigEndian.Uint32(header[:4])
+		switch string(header[4:]) {
+		case "IHDR":
+			var ihdr [13]byte
+			if length != 13 {
+				return false
+			}
+			if _, err := io.ReadFull(br, ihdr[:]); err != nil {
+				return false
+			}
+			// gray with alpha and truecolor with alpha
+			if ihdr[9] == 4 || ihdr[9] == 6 {
+				return true
+			}
+			length = 0
+		case "tRNS":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+
+		// skip rest of chunk data and CRC
+		if _, err := br.Discard(int(length) + 4); err != nil {
+			return false
+		}
+	}
+}
+
+// exifOrientation reads orientation tag from EXIF segment of JPEG image
+// 1 is returned if there is no EXIF or no orientation tag
+func exifOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+
+	var marker [2]byte
+	if _, err := io.ReadFull(br, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+
+	for {
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+
+		// metadata segments precede start of scan
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			return 1
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+	}
+}
+
+// tiffOrientation reads orientation tag from first IFD of TIFF structure of EXIF
+func tiffOrientation(b []byte) int {
+	if len(b) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(b[4:8]))
+	if offset < 8 || offset+2 > len(b) {
+		return 1
+	}
+
+	count := int(order.Uint16(b[offset:]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(b) {
+			return 1
+		}
+
+		if order.Uint16(b[entry:]) == 0x0112 {
+			if v := int(order.Uint16(b[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+
+	return 1
+}
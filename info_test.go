@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/belousandrey/image-resize-service/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exifSegment is APP1 segment with big endian EXIF, which has only orientation tag
+var exifSegment = []byte{
+	0xFF, 0xE1, 0x00, 0x22,
+	'E', 'x', 'i', 'f', 0x00, 0x00,
+	'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08,
+	0x00, 0x01,
+	0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+}
+
+func TestInfoHandler(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	registry := NewRegistry()
+	defer registry.Cleanup()
+	cache := NewTTLCache(0, registry, logger)
+	settings := NewSettings(60)
+
+	original, err := ioutil.ReadFile("testdata/gopher.original.jpg")
+	require.NoError(t, err)
+
+	t.Run("jpeg with orientation", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		imageLocation := "https://golang.org/rotated.jpg"
+
+		f, err := ioutil.TempFile("", "")
+		require.NoError(t, err)
+		f.Write(original[:2])
+		f.Write(exifSegment)
+		f.Write(original[2:])
+		f.Close()
+
+		downloader := mock.NewMockDownloader(ctrl)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(f.Name(), nil).Times(1)
+
+		handler := &infoHandler{cache, settings, 0, downloader, logger}
+		for n := 0; n < 2; n++ {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/info", nil)
+			req.Form = url.Values{"url": {imageLocation}}
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			var info ImageInfo
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(original))
+			require.NoError(t, err)
+			assert.Equal(t, ImageInfo{
+				Width:       config.Width,
+				Height:      config.Height,
+				Format:      "jpeg",
+				Size:        int64(len(original) + len(exifSegment)),
+				Orientation: 6,
+				ColorModel:  "ycbcr",
+				HasAlpha:    false,
+			}, info)
+		}
+	})
+	t.Run("png with alpha", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+		img.Set(0, 0, color.NRGBA{R: 255, A: 128})
+
+		f, err := ioutil.TempFile("", "")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		require.NoError(t, png.Encode(f, img))
+		f.Close()
+
+		info, err := probeImage(f.Name())
+		require.NoError(t, err)
+		assert.Equal(t, "png", info.Format)
+		assert.Equal(t, 3, info.Width)
+		assert.Equal(t, 2, info.Height)
+		assert.Equal(t, 1, info.Orientation)
+		assert.Equal(t, "nrgba", info.ColorModel)
+		assert.True(t, info.HasAlpha)
+	})
+	t.Run("opaque png", func(t *testing.T) {
+		img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+		draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+		f, err := ioutil.TempFile("", "")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		require.NoError(t, png.Encode(f, img))
+		f.Close()
+
+		info, err := probeImage(f.Name())
+		require.NoError(t, err)
+		assert.Equal(t, "png", info.Format)
+		assert.False(t, info.HasAlpha)
+	})
+	t.Run("not an image", func(t *testing.T) {
+		info, err := probeImage("info.go")
+		assert.Nil(t, info)
+
+		var requestErr *RequestError
+		require.True(t, errors.As(err, &requestErr))
+		assert.Equal(t, "unsupported_format", requestErr.Code)
+	})
+}
@@ -2,9 +2,12 @@ package main //package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -14,101 +17,259 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/ReneKroon/ttlcache"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 )
 
-var allowedContentTypes = map[string]bool{"image/jpeg": true}
+var allowedContentTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+// requestIDHeader is a header with ID of request, it is passed to logs and error responses
+const requestIDHeader = "X-Request-Id"
 
 // resizeHandler is a struct to serve resize handler
 type resizeHandler struct {
-	cache      *ttlcache.Cache
-	ttl        int
-	reg        Registry
-	imager     Imager
-	downloader Downloader
-	logger     *log.Logger
+	cache       Cache
+	settings    *Settings
+	timeout     time.Duration
+	imager      Imager
+	downloader  Downloader
+	logger      *log.Logger
+	uploadLimit int64
 }
 
 // ServeHTTP passes request to ResizeHandler and logs results
+// request context gets a deadline if timeout is configured
+// request ID is taken from X-Request-Id header or generated, and is returned to client
+// size of uploaded images is limited if upload limit is configured
 func (fh *resizeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	status, err := ResizeHandler(w, r, fh.cache, fh.ttl, fh.reg, fh.imager, fh.downloader)
+	if fh.timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), fh.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if fh.uploadLimit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, fh.uploadLimit)
+	}
+
+	requestID := setRequestID(w, r)
+
+	status, err := ResizeHandler(w, r, fh.cache, fh.settings, fh.imager, fh.downloader)
 	if err != nil {
 		fh.logger.SetPrefix("ERROR: ")
-		fh.logger.Println("status:", status, "| ", err.Error())
+		fh.logger.Println("request:", requestID, "| status:", status, "| ", err.Error())
 	} else {
 		fh.logger.SetPrefix("INFO: ")
-		fh.logger.Println("status: ", status, "| resized image from "+strings.ToLower(r.Form.Get("url")))
+		fh.logger.Println("request:", requestID, "| status: ", status, "| resized image from "+strings.ToLower(r.Form.Get("url")))
 	}
 }
 
+// setRequestID takes request ID from X-Request-Id header or generates it, ID is returned to client
+func setRequestID(w http.ResponseWriter, r *http.Request) string {
+	requestID := r.Header.Get(requestIDHeader)
+	if len(requestID) == 0 {
+		requestID = newRequestID()
+		r.Header.Set(requestIDHeader, requestID)
+	}
+	w.Header().Set(requestIDHeader, requestID)
+
+	return requestID
+}
+
+// newRequestID returns random ID of request
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // ResizeHandler covers all routine with file download, image conversion and resize, client responses
-func ResizeHandler(w http.ResponseWriter, r *http.Request, c *ttlcache.Cache, ttl int, reg Registry, i Imager, d Downloader) (int, error) {
+// download and image processing are aborted when request context is done
+// HEAD request is processed as GET one, but image is not written to response
+// POST request carries image itself instead of its URL
+func ResizeHandler(w http.ResponseWriter, r *http.Request, c Cache, s *Settings, i Imager, d Downloader) (int, error) {
+	ctx := r.Context()
 	fx := NewImageFixture()
+	fx.RequestID = r.Header.Get(requestIDHeader)
 
-	if r.Method != http.MethodGet {
-		return fx.respondWithError(w, http.StatusMethodNotAllowed, errors.New("only GET method allowed"))
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		fx.Head = r.Method == http.MethodHead
+		setClientHints(w)
+	case http.MethodPost:
+		return fx.resizeUpload(w, r, c, s, i, d)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		return fx.respondWithError(w, http.StatusMethodNotAllowed, newRequestError("method_not_allowed", errors.New("only GET, HEAD and POST methods allowed")))
 	}
 
-	err := fx.getParamsFromRequest(w, r)
+	err := fx.getParamsFromRequest(r, s)
 	if err != nil {
 		return fx.respondWithError(w, http.StatusBadRequest, err)
 	}
+	policy := s.CachePolicy(fx.Params.Preset, fx.Params.URL)
 
-	if fx.upToDate(r, c) {
-		return fx.respondWithRedirect(w)
+	b, header, existsResized := c.GetVariant(fx.File.Key, fx.variant())
+	if existsResized {
+		fx.setVariantHeader(header, b)
+		if fx.upToDate(r) {
+			return fx.respondWithRedirect(w, policy)
+		}
+
+		return fx.respondWithImage(w, bytes.NewBuffer(b), policy)
+	}
+
+	status, err := fx.prepareWatermark(ctx, c, s, d)
+	if err != nil {
+		return fx.respondWithError(w, status, err)
 	}
 
-	exists := fx.GetFromCache(c)
+	path, exists := c.GetOriginal(fx.File.Key)
 	if !exists {
-		fx.File.Path, err = d.StoreFileToTemp(fx.Params.URL)
+		path, err = d.StoreFileToTemp(ctx, fx.Params.URL)
 		if err != nil {
-			return fx.respondWithError(w, http.StatusInternalServerError, err)
+			return fx.respondWithFallback(w, r, c, s, i, originErrorStatus(ctx, err), err)
 		}
 
-		fx.SetToCache(c, reg)
-	} else {
-		resized, existsResized := fx.FindInCache(c)
-		if existsResized {
-			b, err := ioutil.ReadFile(resized)
-			if err == nil {
-				buffer := new(bytes.Buffer)
-				buffer.Write(b)
-				return fx.respondWithImage(w, buffer, fx.Params.URL, ttl)
-			}
+		path, err = c.SetOriginal(fx.File.Key, path)
+		if err != nil {
+			return fx.respondWithError(w, http.StatusInternalServerError, err)
 		}
 	}
+	fx.File.Path = path
+
+	status, err = fx.decode(ctx, i)
+	if err != nil {
+		return fx.respondWithFallback(w, r, c, s, i, status, err)
+	}
+
+	buffer, status, err := fx.resize(ctx, c, i)
+	if err != nil {
+		return fx.respondWithError(w, status, err)
+	}
+
+	return fx.respondWithImage(w, buffer, policy)
+}
+
+// decode opens original image and decodes it, only images of allowed types are decoded
+// requested frame of animated image is selected, otherwise all frames of animated GIF are resized
+func (fx *ImageFixture) decode(ctx context.Context, i Imager) (int, error) {
+	var err error
 
 	fx.File.Handler, err = i.Open(fx.File.Path)
 	if err != nil {
-		return fx.respondWithError(w, http.StatusInternalServerError, err)
+		return http.StatusInternalServerError, err
 	}
 	defer fx.File.Handler.Close()
 
 	err = fx.checkFileContentType(allowedContentTypes)
 	if err != nil {
-		return fx.respondWithError(w, http.StatusBadRequest, err)
+		return http.StatusBadRequest, err
+	}
+
+	err = fx.readOriginalSize()
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	err = i.Decode(ctx, fx.File.Handler)
+	if err != nil {
+		var requestErr *RequestError
+		if errors.As(err, &requestErr) {
+			return http.StatusBadRequest, err
+		}
+		return contextErrorStatus(ctx, http.StatusInternalServerError), err
+	}
+
+	if fx.Params.Frame >= 0 {
+		err = i.Frame(fx.Params.Frame)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+	} else if fx.File.ContentType == "image/gif" && i.Frames() > 1 {
+		fx.File.Animated = true
+	}
+
+	return http.StatusOK, nil
+}
+
+// resize resizes decoded image, puts it to cache and returns encoded result
+// image scaled by device pixel ratio is not enlarged over size of original
+// padding is a part of requested size, so image is resized to fit size without padding
+// mask and border are applied last, so caption and watermark are cut by mask too
+func (fx *ImageFixture) resize(ctx context.Context, c Cache, i Imager) (*bytes.Buffer, int, error) {
+	width, height := fx.Params.Width, fx.Params.Height
+	if pad := uint64(2 * fx.Params.Pad); pad > 0 {
+		if width > 0 {
+			width -= pad
+		}
+		if height > 0 {
+			height -= pad
+		}
+	}
+	if fx.Params.DPR > 1 {
+		width, height = fitSize(width, height, uint64(fx.File.Width), uint64(fx.File.Height))
 	}
 
-	err = i.Decode(fx.File.Handler)
+	err := i.Resize(ctx, uint(width), uint(height), fx.Params.Sharpen)
 	if err != nil {
-		return fx.respondWithError(w, http.StatusInternalServerError, err)
+		return nil, contextErrorStatus(ctx, http.StatusInternalServerError), err
+	}
+
+	for _, f := range fx.Params.Filters {
+		err = i.Filter(ctx, f.Name, f.Value)
+		if err != nil {
+			return nil, contextErrorStatus(ctx, http.StatusInternalServerError), err
+		}
+	}
+
+	if fx.Params.Pad > 0 {
+		err = i.Pad(ctx, fx.Params.Pad, fx.Params.Background)
+		if err != nil {
+			return nil, contextErrorStatus(ctx, http.StatusInternalServerError), err
+		}
+	}
+
+	if t := fx.Params.Caption; t != nil {
+		err = i.Text(ctx, t.Text, t.Size, t.Color, t.Background, t.Position)
+		if err != nil {
+			return nil, contextErrorStatus(ctx, http.StatusInternalServerError), err
+		}
 	}
 
-	i.Resize(uint(fx.Params.Width), uint(fx.Params.Height))
-	resized, err := i.StoreResizedToTempFile()
+	if w := fx.Params.Watermark; w != nil {
+		err = i.Overlay(ctx, w.Image, w.Position, w.Margin, w.Opacity, w.Scale)
+		if err != nil {
+			return nil, contextErrorStatus(ctx, http.StatusInternalServerError), err
+		}
+	}
+
+	if fx.masked() || fx.Params.Border > 0 {
+		err = i.Mask(ctx, fx.Params.Mask, fx.Params.Radius, fx.Params.Border, fx.Params.BorderColor)
+		if err != nil {
+			return nil, contextErrorStatus(ctx, http.StatusInternalServerError), err
+		}
+	}
+
+	// image is encoded once, the same content is cached and returned to client
+	buffer, err := i.Encode(ctx, fx.outputFormat(), fx.Params.Background)
+	if err != nil {
+		return nil, contextErrorStatus(ctx, http.StatusInternalServerError), err
+	}
+	fx.SetEtag(buffer.Bytes())
+	fx.File.LastModified = time.Now()
+
+	resized, err := writeTempFile(buffer.Bytes())
 	if err != nil {
-		fx.respondWithError(w, http.StatusInternalServerError, err)
+		return nil, http.StatusInternalServerError, err
 	}
-	fx.UpdateValueInCache(c, resized, reg)
 
-	buffer, err := i.Encode()
+	err = c.SetVariant(fx.File.Key, fx.variant(), resized, fx.variantHeader())
 	if err != nil {
-		return fx.respondWithError(w, http.StatusInternalServerError, err)
+		return nil, http.StatusInternalServerError, err
 	}
 
-	return fx.respondWithImage(w, buffer, fx.Params.URL, ttl)
+	return buffer, http.StatusOK, nil
 }
 
 // formHandler is simple struct to serve form for image resize
@@ -127,45 +288,120 @@ func (fh *formHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	t.Execute(w, fh.port)
 }
 
+// statsHandler serves cache stats
+type statsHandler struct {
+	cache Cache
+}
+
+// ServeHTTP writes cache stats as JSON
+func (sh *statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sh.cache.Stats())
+}
+
+// config contains application settings from command line flags
+type config struct {
+	port      int
+	ttl       int
+	timeout   int
+	diskLimit int64
+	cacheDir  string
+	redis     string
+	memLimit  int64
+	settings  string
+	upload    int64
+}
+
 func main() {
-	port, ttl := readFlags()
+	cfg := readFlags()
 
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 
-	// key-value storage with expiring keys
-	cache := ttlcache.NewCache()
-	cache.SetTTL(time.Second * time.Duration(ttl))
+	// cache policies and presets
+	settings := NewSettings(cfg.ttl)
+	if cfg.settings != "" {
+		var err error
+		settings, err = LoadSettings(cfg.settings, cfg.ttl)
+		if err != nil {
+			log.Fatalln("load settings: ", err.Error())
+		}
+	}
 
 	// storage for all generated temp files
+	// disk usage is bounded by least recently used files eviction
 	registry := NewRegistry()
+	registry.SetLimit(cfg.diskLimit)
+
+	// key-value storage with expiring keys
+	// temp files of expired images are removed right away
+	cache := NewTTLCache(time.Second*time.Duration(cfg.ttl), registry, logger)
+
+	// persistent mode keeps cache on disk between restarts
+	if cfg.cacheDir != "" {
+		store, err := NewDiskStore(cfg.cacheDir)
+		if err != nil {
+			log.Fatalln("open cache directory: ", err.Error())
+		}
+		registry.SetStore(store)
+
+		restored, err := cache.Restore(time.Second * time.Duration(cfg.ttl))
+		if err != nil {
+			log.Fatalln("restore cache: ", err.Error())
+		}
+		fmt.Println("Restored images from cache directory: ", restored)
+	}
+
+	// replicas share resized images through Redis, local cache keeps originals only
+	var shared Cache = cache
+	if cfg.redis != "" {
+		shared = NewRedisCache(NewRedisPool(cfg.redis), time.Second*time.Duration(cfg.ttl), cache, logger)
+	}
+
+	// hot resized images are served from memory
+	if cfg.memLimit > 0 {
+		shared = NewMemoryCache(shared, cfg.memLimit, time.Second*time.Duration(cfg.ttl))
+	}
 
 	// chan to capture SIGTERM
 	signals := make(chan os.Signal, 1)
 
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
-	go func(signals <-chan os.Signal, reg Registry) {
+	go func(signals <-chan os.Signal, reg *Registry, persistent bool) {
 		<-signals
 		exitCode := 0
-		err := reg.Cleanup()
-		if err != nil {
-			fmt.Println("remove temp files: ", err.Error())
-			exitCode = 1
+		if !persistent {
+			err := reg.Cleanup()
+			if err != nil {
+				fmt.Println("remove temp files: ", err.Error())
+				exitCode = 1
+			}
 		}
 
 		os.Exit(exitCode)
-	}(signals, registry)
+	}(signals, registry, cfg.cacheDir != "")
 
 	mux := http.NewServeMux()
-	mux.Handle("/", &formHandler{port: port})
-	mux.Handle("/upload", &resizeHandler{cache: cache, ttl: ttl, reg: registry, imager: NewImager(), downloader: NewDownloader(), logger: logger})
+	mux.Handle("/", &formHandler{port: cfg.port})
+	mux.Handle("/upload", &resizeHandler{cache: shared, settings: settings, timeout: time.Second * time.Duration(cfg.timeout), imager: NewImager(), downloader: NewDownloader(), logger: logger, uploadLimit: cfg.upload})
+	mux.Handle("/info", &infoHandler{cache: shared, settings: settings, timeout: time.Second * time.Duration(cfg.timeout), downloader: NewDownloader(), logger: logger})
+	mux.Handle("/placeholder", &placeholderHandler{cache: shared, settings: settings, timeout: time.Second * time.Duration(cfg.timeout), downloader: NewDownloader(), logger: logger})
+	mux.Handle("/srcset", &srcsetHandler{cache: shared, settings: settings, timeout: time.Second * time.Duration(cfg.timeout), imager: NewImager(), downloader: NewDownloader(), logger: logger})
+	mux.Handle("/stats", &statsHandler{cache: shared})
 
-	fmt.Println("Listening on http://localhost:" + strconv.Itoa(port))
-	http.ListenAndServe(":"+strconv.Itoa(port), mux)
+	fmt.Println("Listening on http://localhost:" + strconv.Itoa(cfg.port))
+	http.ListenAndServe(":"+strconv.Itoa(cfg.port), mux)
 }
 
-func readFlags() (port, ttl int) {
-	pflag.IntVarP(&port, "port", "p", 8080, "system port number")
-	pflag.IntVarP(&ttl, "ttl", "t", 3600, "image cache in seconds")
+func readFlags() (cfg config) {
+	pflag.IntVarP(&cfg.port, "port", "p", 8080, "system port number")
+	pflag.IntVarP(&cfg.ttl, "ttl", "t", 3600, "image cache in seconds")
+	pflag.StringVar(&cfg.settings, "config", "", "JSON file with cache policies and presets")
+	pflag.IntVar(&cfg.timeout, "timeout", 30, "request processing deadline in seconds, 0 to disable")
+	pflag.Int64Var(&cfg.diskLimit, "disk-limit", 0, "max bytes of temp files, 0 to disable")
+	pflag.StringVar(&cfg.cacheDir, "cache-dir", "", "directory for persistent cache, temp files are used if empty")
+	pflag.StringVar(&cfg.redis, "redis", "", "address of Redis server shared by replicas, e.g. localhost:6379")
+	pflag.Int64Var(&cfg.memLimit, "memory-limit", 0, "max bytes of resized images kept in memory, 0 to disable")
+	pflag.Int64Var(&cfg.upload, "upload-limit", 10<<20, "max bytes of uploaded image, 0 to disable")
 	pflag.Parse()
 
 	return
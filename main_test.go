@@ -2,9 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,7 +20,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/ReneKroon/ttlcache"
 	"github.com/belousandrey/image-resize-service/mock"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -23,22 +29,22 @@ import (
 const URL = "/upload"
 
 func TestResizeHandler(t *testing.T) {
-	cache := ttlcache.NewCache()
-	reg := NewRegistry()
 	ttl := 60
-
 	logger := log.New(ioutil.Discard, "", 0)
+	cache := NewTTLCache(0, NewRegistry(), logger)
+	settings := NewSettings(ttl)
 
 	t.Run("wrong method", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 
 		rec := httptest.NewRecorder()
-		req := httptest.NewRequest("POST", URL, nil)
-		handler := &resizeHandler{cache, ttl, reg, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger}
+		req := httptest.NewRequest("PUT", URL, nil)
+		handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
 		handler.ServeHTTP(rec, req)
 
 		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+		assert.Equal(t, "GET, HEAD, POST", rec.Header().Get("Allow"))
 	})
 	t.Run("negative width", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -48,10 +54,17 @@ func TestResizeHandler(t *testing.T) {
 		req := httptest.NewRequest("GET", URL, nil)
 		req.Form = url.Values{"url": {"http://example.com/image.jpg"}, "width": {"-100"}, "height": {"100"}}
 
-		handler := &resizeHandler{cache, ttl, reg, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger}
+		handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
 		handler.ServeHTTP(rec, req)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		var body errorBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, "invalid_width", body.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.Equal(t, rec.Header().Get(requestIDHeader), body.RequestID)
+		assert.NotEmpty(t, body.RequestID)
 	})
 	t.Run("negative height", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -61,7 +74,7 @@ func TestResizeHandler(t *testing.T) {
 		req := httptest.NewRequest("GET", URL, nil)
 		req.Form = url.Values{"url": {"http://example.com/image.jpg"}, "width": {"100"}, "height": {"-100"}}
 
-		handler := &resizeHandler{cache, ttl, reg, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger}
+		handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
 		handler.ServeHTTP(rec, req)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
@@ -74,17 +87,170 @@ func TestResizeHandler(t *testing.T) {
 		req := httptest.NewRequest("GET", URL, nil)
 		req.Form = url.Values{"url": {"wrong URL"}, "width": {"100"}, "height": {"100"}}
 
-		handler := &resizeHandler{cache, ttl, reg, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger}
+		handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
 		handler.ServeHTTP(rec, req)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+		var body errorBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, "invalid_url", body.Code)
+	})
+	t.Run("origin not found", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		imageLocation := "https://golang.org/missing.jpg"
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", URL, nil)
+		req.Header.Set(requestIDHeader, "abc")
+		req.Form = url.Values{"url": {imageLocation}, "width": {"100"}, "height": {"100"}}
+
+		downloader := mock.NewMockDownloader(ctrl)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).
+			Return("", &OriginError{Code: "origin_not_found", Status: http.StatusNotFound, Err: errors.New("bad status: 404 Not Found")}).Times(1)
+
+		handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(ctrl), downloader, logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, "abc", rec.Header().Get(requestIDHeader))
+
+		var body errorBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, errorBody{Code: "origin_not_found", Message: "bad status: 404 Not Found", RequestID: "abc"}, body)
+	})
+	t.Run("deadline exceeded", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		imageLocation := "https://golang.org/slow.jpg"
+		width, height := 100, 100
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", URL, nil)
+		req.Form = url.Values{"url": {imageLocation}, "width": {strconv.Itoa(width)}, "height": {strconv.Itoa(height)}}
+
+		downloader := mock.NewMockDownloader(ctrl)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return("", context.DeadlineExceeded).Times(1)
+
+		handler := &resizeHandler{cache, settings, time.Nanosecond, mock.NewMockImager(ctrl), downloader, logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	})
+	t.Run("fallback", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		imageLocation := "https://golang.org/missing.jpg"
+		width, height := 50, 40
+
+		registry := NewRegistry()
+		defer registry.Cleanup()
+		fallbackCache := NewTTLCache(0, registry, logger)
+		fallbackSettings := NewSettings(ttl)
+		fallbackSettings.Fallback = &Fallback{Image: "testdata/gopher.original.jpg"}
+
+		downloader := mock.NewMockDownloader(ctrl)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).
+			Return("", &OriginError{Code: "origin_not_found", Status: http.StatusNotFound, Err: errors.New("bad status: 404 Not Found")}).Times(2)
+
+		handler := &resizeHandler{fallbackCache, fallbackSettings, 0, NewImager(), downloader, logger, 0}
+
+		var etag string
+		for n := 0; n < 2; n++ {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", URL, nil)
+			req.Form = url.Values{"url": {imageLocation}, "width": {strconv.Itoa(width)}, "height": {strconv.Itoa(height)}}
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "origin_not_found", rec.Header().Get(fallbackHeader))
+			assert.Equal(t, fmt.Sprintf("public, max-age=%d", fallbackMaxAge), rec.Header().Get("Cache-Control"))
+			assert.Equal(t, "image/jpeg", http.DetectContentType(rec.Body.Bytes()))
+			if n > 0 {
+				// second response is taken from cache
+				assert.Equal(t, etag, rec.Header().Get("Etag"))
+			}
+			etag = rec.Header().Get("Etag")
+		}
+	})
+	t.Run("fallback with filters", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		imageLocation := "https://golang.org/missing.jpg"
+
+		registry := NewRegistry()
+		defer registry.Cleanup()
+		fallbackCache := NewTTLCache(0, registry, logger)
+		fallbackSettings := NewSettings(ttl)
+		fallbackSettings.Fallback = &Fallback{Image: "testdata/gopher.original.jpg"}
+
+		downloader := mock.NewMockDownloader(ctrl)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).
+			Return("", &OriginError{Code: "origin_not_found", Status: http.StatusNotFound, Err: errors.New("bad status: 404 Not Found")}).Times(1)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", URL, nil)
+		req.Form = url.Values{"url": {imageLocation}, "width": {"50"}, "height": {"40"}, "dpr": {"2"}, "grayscale": {"1"}}
+
+		handler := &resizeHandler{fallbackCache, fallbackSettings, 0, NewImager(), downloader, logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "origin_not_found", rec.Header().Get(fallbackHeader))
+
+		img, err := jpeg.Decode(rec.Body)
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 100, 80), img.Bounds())
+		r, g, b, _ := img.At(50, 40).RGBA()
+		assert.InDelta(t, r>>8, g>>8, 8)
+		assert.InDelta(t, g>>8, b>>8, 8)
+
+		// variant of fallback is cached under name with filters
+		fx := NewImageFixture()
+		fx.Params.Filters = []Filter{{Name: "grayscale", Value: 1}}
+		fx.Params.Sharpen = fallbackSettings.SharpenAmount("")
+		fx.Params.DPR = 2
+		fx.SetParams("fallback:testdata/gopher.original.jpg", 100, 80)
+		_, _, ok := fallbackCache.GetVariant(fx.File.Key, fx.variant())
+		assert.True(t, ok)
+	})
+	t.Run("cache failure", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		imageLocation := "https://golang.org/gopher.jpg"
+		original := "testdata/gopher.original.jpg"
+		width, height := 100, 100
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", URL, nil)
+		req.Form = url.Values{"url": {imageLocation}, "width": {strconv.Itoa(width)}, "height": {strconv.Itoa(height)}}
+
+		downloader := mock.NewMockDownloader(ctrl)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(original, nil).Times(1)
+
+		c := mock.NewMockCache(ctrl)
+		c.EXPECT().GetVariant(gomock.Any(), variantName(uint64(width), uint64(height))).Return(nil, nil, false).Times(1)
+		c.EXPECT().GetOriginal(gomock.Any()).Return("", false).Times(1)
+		c.EXPECT().SetOriginal(gomock.Any(), original).Return("", errors.New("disk is full")).Times(1)
+
+		handler := &resizeHandler{c, settings, 0, mock.NewMockImager(ctrl), downloader, logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
 	})
 	t.Run("wrong content type", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 
-		imageLocation := "https://golang.org/gopher.png"
-		original := "testdata/wrong_content_type.png"
+		imageLocation := "https://golang.org/gopher.bmp"
+		original := "testdata/wrong_content_type.bmp"
 		width, height := 100, 100
 
 		rec := httptest.NewRecorder()
@@ -92,7 +258,7 @@ func TestResizeHandler(t *testing.T) {
 		req.Form = url.Values{"url": {imageLocation}, "width": {strconv.Itoa(width)}, "height": {strconv.Itoa(height)}}
 
 		downloader := mock.NewMockDownloader(ctrl)
-		downloader.EXPECT().StoreFileToTemp(imageLocation).Return(original, nil).Times(1)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(original, nil).Times(1)
 
 		fh, err := os.Open(original)
 		require.NoError(t, err)
@@ -100,7 +266,7 @@ func TestResizeHandler(t *testing.T) {
 		imager := mock.NewMockImager(ctrl)
 		imager.EXPECT().Open(original).Return(fh, nil).Times(1)
 
-		handler := &resizeHandler{cache, ttl, reg, imager, downloader, logger}
+		handler := &resizeHandler{cache, settings, 0, imager, downloader, logger, 0}
 		handler.ServeHTTP(rec, req)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
@@ -118,32 +284,33 @@ func TestResizeHandler(t *testing.T) {
 		req.Form = url.Values{"url": {imageLocation}, "width": {strconv.Itoa(width)}, "height": {strconv.Itoa(height)}}
 
 		downloader := mock.NewMockDownloader(ctrl)
-		downloader.EXPECT().StoreFileToTemp(imageLocation).Return(original, nil).Times(1)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(original, nil).Times(1)
 
 		fh, err := os.Open(original)
 		require.NoError(t, err)
 
 		imager := mock.NewMockImager(ctrl)
 		imager.EXPECT().Open(original).Return(fh, nil).Times(1)
-		imager.EXPECT().Decode(fh).Return(nil).Times(1)
-		imager.EXPECT().Resize(uint(width), uint(height)).Times(1)
-		imager.EXPECT().StoreResizedToTempFile().Return(resized, nil).Times(1)
+		imager.EXPECT().Decode(gomock.Any(), fh).Return(nil).Times(1)
+		imager.EXPECT().Resize(gomock.Any(), uint(width), uint(height), 0.0).Return(nil).Times(1)
 
 		b, err := ioutil.ReadFile(resized)
 		require.NoError(t, err)
 
 		buffer := new(bytes.Buffer)
 		buffer.Write(b)
-		imager.EXPECT().Encode().Return(buffer, nil).Times(1)
+		imager.EXPECT().Encode(gomock.Any(), "jpeg", defaultBackground).Return(buffer, nil).Times(1)
 
-		handler := &resizeHandler{cache, ttl, reg, imager, downloader, logger}
+		handler := &resizeHandler{cache, settings, 0, imager, downloader, logger, 0}
 		handler.ServeHTTP(rec, req)
 
 		assert.Equal(t, http.StatusOK, rec.Code)
 		assert.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
 		assert.Equal(t, "3609", rec.Header().Get("Content-Length"))
-		assert.NotEmpty(t, rec.Header().Get("Etag"))
-		assert.Equal(t, fmt.Sprintf("max-age:%d, public", ttl), rec.Header().Get("Cache-Control"))
+		etag := NewImageFixture()
+		etag.SetEtag(b)
+		assert.Equal(t, etag.File.Etag, rec.Header().Get("Etag"))
+		assert.Equal(t, fmt.Sprintf("public, max-age=%d", ttl), rec.Header().Get("Cache-Control"))
 
 		lm, err := time.Parse(time.RFC1123, rec.Header().Get("Last-Modified"))
 		require.NoError(t, err)
@@ -152,21 +319,468 @@ func TestResizeHandler(t *testing.T) {
 		require.NoError(t, err)
 		assert.WithinDuration(t, time.Now(), exp, time.Duration(24*time.Hour)) // because of timezones
 	})
-	t.Run("not modified", func(t *testing.T) {
+	t.Run("cached", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 
 		imageLocation := "https://golang.org/gopher.jpg"
 		width, height := 100, 100
 
+		b, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+		require.NoError(t, err)
+		etag := NewImageFixture()
+		etag.SetEtag(b)
+
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest("GET", URL, nil)
 		req.Form = url.Values{"url": {imageLocation}, "width": {strconv.Itoa(width)}, "height": {strconv.Itoa(height)}}
-		req.Header.Set("If-None-Match", "70c8cb786769432edd9f1cd55cf1b135")
 
-		handler := &resizeHandler{cache, ttl, reg, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger}
+		handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, etag.File.Etag, rec.Header().Get("Etag"))
+		assert.Equal(t, b, rec.Body.Bytes())
+	})
+	t.Run("filters", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		original := "testdata/gopher.original.jpg"
+		b, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+		require.NoError(t, err)
+
+		fh, err := os.Open(original)
+		require.NoError(t, err)
+
+		// original is cached already, filtered image is a new variant
+		imager := mock.NewMockImager(ctrl)
+		imager.EXPECT().Open(original).Return(fh, nil).Times(1)
+		imager.EXPECT().Decode(gomock.Any(), fh).Return(nil).Times(1)
+		imager.EXPECT().Resize(gomock.Any(), uint(100), uint(100), 0.0).Return(nil).Times(1)
+		gomock.InOrder(
+			imager.EXPECT().Filter(gomock.Any(), "grayscale", 1.0).Return(nil).Times(1),
+			imager.EXPECT().Filter(gomock.Any(), "blur", 2.0).Return(nil).Times(1),
+		)
+		imager.EXPECT().Encode(gomock.Any(), "jpeg", defaultBackground).Return(bytes.NewBuffer(b), nil).Times(1)
+
+		for n := 0; n < 2; n++ {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", URL, nil)
+			req.Form = url.Values{"url": {"https://golang.org/gopher.jpg"}, "width": {"100"}, "height": {"100"}, "blur": {"2"}, "grayscale": {"1"}}
+
+			handler := &resizeHandler{cache, settings, 0, imager, mock.NewMockDownloader(ctrl), logger, 0}
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+	})
+	t.Run("text", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		original := "testdata/gopher.original.jpg"
+		b, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+		require.NoError(t, err)
+
+		fh, err := os.Open(original)
+		require.NoError(t, err)
+
+		imager := mock.NewMockImager(ctrl)
+		imager.EXPECT().Open(original).Return(fh, nil).Times(1)
+		imager.EXPECT().Decode(gomock.Any(), fh).Return(nil).Times(1)
+		imager.EXPECT().Resize(gomock.Any(), uint(100), uint(100), 0.0).Return(nil).Times(1)
+		imager.EXPECT().Text(gomock.Any(), "Sale", 16.0, color.NRGBA{255, 0, 0, 255}, color.NRGBA{}, "top").Return(nil).Times(1)
+		imager.EXPECT().Encode(gomock.Any(), "jpeg", defaultBackground).Return(bytes.NewBuffer(b), nil).Times(1)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", URL, nil)
+		req.Form = url.Values{"url": {"https://golang.org/gopher.jpg"}, "width": {"100"}, "height": {"100"},
+			"text": {"Sale"}, "text_size": {"16"}, "text_color": {"ff0000"}, "text_position": {"top"}}
+
+		handler := &resizeHandler{cache, settings, 0, imager, mock.NewMockDownloader(ctrl), logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+	t.Run("padding", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		original := "testdata/gopher.original.jpg"
+		b, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+		require.NoError(t, err)
+		bg := color.NRGBA{0, 0, 0, 0}
+
+		fh, err := os.Open(original)
+		require.NoError(t, err)
+
+		// image is resized to fit requested size without padding
+		imager := mock.NewMockImager(ctrl)
+		imager.EXPECT().Open(original).Return(fh, nil).Times(1)
+		imager.EXPECT().Decode(gomock.Any(), fh).Return(nil).Times(1)
+		imager.EXPECT().Resize(gomock.Any(), uint(80), uint(80), 0.0).Return(nil).Times(1)
+		imager.EXPECT().Pad(gomock.Any(), 10, bg).Return(nil).Times(1)
+		imager.EXPECT().Frame(0).Return(nil).Times(1)
+		imager.EXPECT().Encode(gomock.Any(), "png", bg).Return(bytes.NewBuffer(b), nil).Times(1)
+
+		for n := 0; n < 2; n++ {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", URL, nil)
+			req.Form = url.Values{"url": {"https://golang.org/gopher.jpg"}, "width": {"100"}, "height": {"100"},
+				"pad": {"10"}, "bg": {"00000000"}, "format": {"png"}}
+
+			handler := &resizeHandler{cache, settings, 0, imager, mock.NewMockDownloader(ctrl), logger, 0}
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+		}
+	})
+	t.Run("circle mask", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		original := "testdata/gopher.original.jpg"
+		b, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+		require.NoError(t, err)
+
+		fh, err := os.Open(original)
+		require.NoError(t, err)
+
+		// masked image is encoded to PNG to keep transparency
+		imager := mock.NewMockImager(ctrl)
+		imager.EXPECT().Open(original).Return(fh, nil).Times(1)
+		imager.EXPECT().Decode(gomock.Any(), fh).Return(nil).Times(1)
+		imager.EXPECT().Resize(gomock.Any(), uint(100), uint(100), 0.0).Return(nil).Times(1)
+		imager.EXPECT().Mask(gomock.Any(), "circle", 0, 3, color.NRGBA{255, 255, 255, 255}).Return(nil).Times(1)
+		imager.EXPECT().Encode(gomock.Any(), "png", defaultBackground).Return(bytes.NewBuffer(b), nil).Times(1)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", URL, nil)
+		req.Form = url.Values{"url": {"https://golang.org/gopher.jpg"}, "width": {"100"}, "height": {"100"},
+			"mask": {"circle"}, "border": {"3"}, "border_color": {"ffffff"}}
+
+		handler := &resizeHandler{cache, settings, 0, imager, mock.NewMockDownloader(ctrl), logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	})
+	t.Run("overlay", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		original := "testdata/gopher.original.jpg"
+		overlay := "https://static.golang.org/badge.png"
+		b, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+		require.NoError(t, err)
+
+		overlays := NewSettings(ttl)
+		overlays.OverlayHosts = []string{"static.golang.org"}
+
+		fh, err := os.Open(original)
+		require.NoError(t, err)
+
+		// overlay is downloaded once and cached as original
+		downloader := mock.NewMockDownloader(ctrl)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), overlay).Return(tempCopy(t, "testdata/wrong_content_type.png"), nil).Times(1)
+
+		imager := mock.NewMockImager(ctrl)
+		imager.EXPECT().Open(original).Return(fh, nil).Times(1)
+		imager.EXPECT().Decode(gomock.Any(), fh).Return(nil).Times(1)
+		imager.EXPECT().Resize(gomock.Any(), uint(100), uint(100), 0.0).Return(nil).Times(1)
+		imager.EXPECT().Overlay(gomock.Any(), gomock.Any(), "center", 0, 1.0, 0.5).Return(nil).Times(1)
+		imager.EXPECT().Encode(gomock.Any(), "jpeg", defaultBackground).Return(bytes.NewBuffer(b), nil).Times(1)
+
+		for n := 0; n < 2; n++ {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", URL, nil)
+			req.Form = url.Values{"url": {"https://golang.org/gopher.jpg"}, "width": {"100"}, "height": {"100"},
+				"overlay": {overlay}, "overlay_position": {"center"}, "overlay_scale": {"0.5"}}
+
+			handler := &resizeHandler{cache, overlays, 0, imager, downloader, logger, 0}
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+	})
+	t.Run("head", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		b, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+		require.NoError(t, err)
+		etag := NewImageFixture()
+		etag.SetEtag(b)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("HEAD", URL, nil)
+		req.Form = url.Values{"url": {"https://golang.org/gopher.jpg"}, "width": {"100"}, "height": {"100"}}
+
+		handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
+		assert.Equal(t, strconv.Itoa(len(b)), rec.Header().Get("Content-Length"))
+		assert.Equal(t, etag.File.Etag, rec.Header().Get("Etag"))
+		assert.Empty(t, rec.Body.Bytes())
+	})
+	t.Run("preset", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		presets := NewSettings(ttl)
+		presets.Presets["thumb"] = &Preset{Width: 100, Height: 100, Cache: &CachePolicy{MaxAge: 600, Immutable: true}}
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", URL, nil)
+		req.Form = url.Values{"url": {"https://golang.org/gopher.jpg"}, "preset": {"thumb"}}
+
+		handler := &resizeHandler{cache, presets, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "public, max-age=600, immutable", rec.Header().Get("Cache-Control"))
+
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", URL, nil)
+		req.Form = url.Values{"url": {"https://golang.org/gopher.jpg"}, "preset": {"unknown"}}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+	t.Run("conditional", func(t *testing.T) {
+		imageLocation := "https://golang.org/gopher.jpg"
+		width, height := 100, 100
+
+		b, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+		require.NoError(t, err)
+		etag := NewImageFixture()
+		etag.SetEtag(b)
+
+		cases := []struct {
+			name   string
+			header string
+			value  string
+			status int
+		}{
+			{"etag match", "If-None-Match", etag.File.Etag, http.StatusNotModified},
+			{"etag mismatch", "If-None-Match", `"70c8cb786769432edd9f1cd55cf1b135"`, http.StatusOK},
+			{"weak etag in list", "If-None-Match", `"70c8cb786769432edd9f1cd55cf1b135", W/` + etag.File.Etag, http.StatusNotModified},
+			{"any etag", "If-None-Match", "*", http.StatusNotModified},
+			{"not modified since", "If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), http.StatusNotModified},
+			{"modified since", "If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK},
+			{"invalid date", "If-Modified-Since", "yesterday", http.StatusOK},
+		}
+
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", URL, nil)
+				req.Form = url.Values{"url": {imageLocation}, "width": {strconv.Itoa(width)}, "height": {strconv.Itoa(height)}}
+				req.Header.Set(tc.header, tc.value)
+
+				handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
+				handler.ServeHTTP(rec, req)
+
+				assert.Equal(t, tc.status, rec.Code)
+				assert.Equal(t, etag.File.Etag, rec.Header().Get("Etag"))
+				assert.NotEmpty(t, rec.Header().Get("Last-Modified"))
+			})
+		}
+	})
+}
+
+func TestResizeHandlerUpload(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	registry := NewRegistry()
+	defer registry.Cleanup()
+	cache := NewTTLCache(0, registry, logger)
+	settings := NewSettings(60)
+
+	original, err := ioutil.ReadFile("testdata/gopher.original.jpg")
+	require.NoError(t, err)
+
+	t.Run("raw body", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", URL+"?width=50&height=40", bytes.NewReader(original))
+		req.Header.Set("Content-Type", "image/jpeg")
+
+		handler := &resizeHandler{cache, settings, 0, NewImager(), NewDownloader(), logger, int64(len(original))}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "image/jpeg", http.DetectContentType(rec.Body.Bytes()))
+		assert.Equal(t, int64(1), cache.Stats()["images"])
+	})
+	t.Run("multipart", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		form := multipart.NewWriter(body)
+		require.NoError(t, form.WriteField("width", "50"))
+		require.NoError(t, form.WriteField("height", "40"))
+		part, err := form.CreateFormFile(uploadField, "gopher.jpg")
+		require.NoError(t, err)
+		_, err = part.Write(original)
+		require.NoError(t, err)
+		require.NoError(t, form.Close())
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", URL, body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+
+		// same content is served from cache
+		handler := &resizeHandler{cache, settings, 0, mock.NewMockImager(gomock.NewController(t)), NewDownloader(), logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "image/jpeg", http.DetectContentType(rec.Body.Bytes()))
+		assert.Equal(t, int64(1), cache.Stats()["images"])
+	})
+	t.Run("too large", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", URL+"?width=50&height=40", bytes.NewReader(original))
+
+		handler := &resizeHandler{cache, settings, 0, NewImager(), NewDownloader(), logger, int64(len(original) - 1)}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+		var body errorBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, "upload_too_large", body.Code)
+	})
+	t.Run("missing image", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", URL+"?width=50&height=40", nil)
+
+		handler := &resizeHandler{cache, settings, 0, NewImager(), NewDownloader(), logger, 0}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		var body errorBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, "missing_image", body.Code)
+	})
+}
+
+func TestResizeHandlerDPR(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	settings := NewSettings(60)
+	imageLocation := "https://golang.org/gopher.jpg"
+
+	resized, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name          string
+		form          url.Values
+		header        http.Header
+		width, height uint
+	}{
+		{"dpr param", url.Values{"width": {"100"}, "height": {"120"}, "dpr": {"2"}}, nil, 200, 240},
+		{"dpr hint", url.Values{"width": {"100"}, "height": {"100"}}, http.Header{"Sec-Ch-Dpr": {"3"}}, 300, 300},
+		{"source size", url.Values{"width": {"100"}, "height": {"150"}, "dpr": {"4"}}, nil, 206, 309},
+		{"width hint", url.Values{}, http.Header{"Width": {"250"}, "Dpr": {"2"}}, 250, 0},
+		{"max dimension", url.Values{"width": {"10000"}, "height": {"0"}}, nil, 8192, 0},
+		{"srcset url with dpr hint", url.Values{"width": {"200"}, "height": {"0"}, "dpr": {"1"}}, http.Header{"Sec-Ch-Dpr": {"2"}}, 200, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			registry := NewRegistry()
+			defer registry.Cleanup()
+			cache := NewTTLCache(0, registry, logger)
+
+			original := tempCopy(t, "testdata/gopher.original.jpg")
+			downloader := mock.NewMockDownloader(ctrl)
+			downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(original, nil).Times(1)
+
+			fh, err := os.Open(original)
+			require.NoError(t, err)
+
+			imager := mock.NewMockImager(ctrl)
+			imager.EXPECT().Open(original).Return(fh, nil).Times(1)
+			imager.EXPECT().Decode(gomock.Any(), fh).Return(nil).Times(1)
+			imager.EXPECT().Resize(gomock.Any(), tc.width, tc.height, 0.0).Return(nil).Times(1)
+			imager.EXPECT().Encode(gomock.Any(), "jpeg", defaultBackground).Return(bytes.NewBuffer(resized), nil).Times(1)
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", URL, nil)
+			req.Form = tc.form
+			req.Form.Set("url", imageLocation)
+			for name, values := range tc.header {
+				req.Header[name] = values
+			}
+
+			handler := &resizeHandler{cache, settings, 0, imager, downloader, logger, 0}
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "Sec-CH-DPR, Sec-CH-Width, DPR, Width", rec.Header().Get("Vary"))
+			assert.Equal(t, "Sec-CH-DPR, Sec-CH-Width, DPR, Width", rec.Header().Get("Accept-CH"))
+		})
+	}
+
+	t.Run("variant of source size", func(t *testing.T) {
+		// image scaled by dpr is limited by size of original, so it does not share variant with image of the same size
+		for _, forms := range [][]url.Values{
+			{{"width": {"100"}, "height": {"150"}, "dpr": {"4"}}, {"width": {"400"}, "height": {"600"}}},
+			{{"width": {"400"}, "height": {"600"}}, {"width": {"100"}, "height": {"150"}, "dpr": {"4"}}},
+		} {
+			ctrl := gomock.NewController(t)
+
+			registry := NewRegistry()
+			cache := NewTTLCache(0, registry, logger)
+
+			downloader := mock.NewMockDownloader(ctrl)
+			downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(tempCopy(t, "testdata/gopher.original.jpg"), nil).Times(1)
+
+			handler := &resizeHandler{cache, settings, 0, NewImager(), downloader, logger, 0}
+			for _, form := range forms {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", URL, nil)
+				req.Form = form
+				req.Form.Set("url", imageLocation)
+				handler.ServeHTTP(rec, req)
+				require.Equal(t, http.StatusOK, rec.Code)
+
+				img, err := jpeg.Decode(rec.Body)
+				require.NoError(t, err)
+				if len(form.Get("dpr")) > 0 {
+					assert.Equal(t, image.Rect(0, 0, 206, 309), img.Bounds())
+				} else {
+					assert.Equal(t, image.Rect(0, 0, 400, 600), img.Bounds())
+				}
+			}
+
+			registry.Cleanup()
+			ctrl.Finish()
+		}
+	})
+	t.Run("invalid dpr", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", URL, nil)
+		req.Form = url.Values{"url": {imageLocation}, "width": {"100"}, "height": {"100"}, "dpr": {"5"}}
+
+		handler := &resizeHandler{NewTTLCache(0, NewRegistry(), logger), settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger, 0}
 		handler.ServeHTTP(rec, req)
 
-		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		var body errorBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, "invalid_dpr", body.Code)
 	})
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// maskCircle is a mask, which keeps circle inscribed in image
+const maskCircle = "circle"
+
+// defaultBorderColor is a color of border if it is not requested
+var defaultBorderColor = color.NRGBA{0, 0, 0, 255}
+
+// setMask reads mask, corner radius and border of resized image
+// radius and border width are set in CSS pixels, so they are multiplied by device pixel ratio
+func (fx *ImageFixture) setMask(form url.Values, dpr float64) error {
+	if value := form.Get("mask"); len(value) > 0 {
+		if value != maskCircle {
+			return newRequestError("invalid_mask", fmt.Errorf("unknown mask %s", value))
+		}
+		fx.Params.Mask = value
+	}
+
+	for _, param := range []struct {
+		name  string
+		code  string
+		value *int
+	}{{"radius", "invalid_mask", &fx.Params.Radius}, {"border", "invalid_border", &fx.Params.Border}} {
+		if value := form.Get(param.name); len(value) > 0 {
+			v, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || v > maxDimension {
+				return newRequestError(param.code, fmt.Errorf("%s has to be in range [0, %d], got %q", param.name, maxDimension, value))
+			}
+			*param.value = int(math.Round(float64(v) * dpr))
+		}
+	}
+
+	if value := form.Get("border_color"); len(value) > 0 {
+		c, err := parseColor(value)
+		if err != nil {
+			return newRequestError("invalid_border", errors.Wrap(err, "parse border color"))
+		}
+		fx.Params.BorderColor = c
+	}
+
+	return nil
+}
+
+// masked checks if mask makes part of resized image transparent
+func (fx *ImageFixture) masked() bool {
+	return len(fx.Params.Mask) > 0 || fx.Params.Radius > 0
+}
+
+// maskName returns parts of variant name with mask and border, e.g. "mask=circle,border=4/000000ff"
+func (fx *ImageFixture) maskName() []string {
+	var parts []string
+	if len(fx.Params.Mask) > 0 {
+		parts = append(parts, "mask="+fx.Params.Mask)
+	}
+	if fx.Params.Radius > 0 {
+		parts = append(parts, "radius="+strconv.Itoa(fx.Params.Radius))
+	}
+	if fx.Params.Border > 0 {
+		parts = append(parts, "border="+strconv.Itoa(fx.Params.Border)+"/"+colorName(fx.Params.BorderColor))
+	}
+
+	return parts
+}
+
+// maskImage returns copy of image cut by mask with border drawn along edge of mask
+// circle mask keeps circle inscribed in image, otherwise image corners are rounded by radius
+// edges are anti-aliased by coverage of pixel computed from distance to edge
+func maskImage(img image.Image, mask string, radius, border int, borderColor color.NRGBA) *image.NRGBA {
+	dst := toNRGBA(img)
+	width, height := float64(dst.Rect.Dx()), float64(dst.Rect.Dy())
+
+	// shape is a rounded rectangle with center cx, cy, half size hw, hh and corner radius r
+	cx, cy, hw, hh, r := width/2, height/2, width/2, height/2, float64(radius)
+	if mask == maskCircle {
+		hw = math.Min(hw, hh)
+		hh, r = hw, hw
+	}
+	r = math.Min(r, math.Min(hw, hh))
+	b := float64(border)
+
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			d := roundedRectDistance(float64(x)+0.5-cx, float64(y)+0.5-cy, hw, hh, r)
+			coverage := clampUnit(0.5 - d)
+
+			p := dst.Pix[y*dst.Stride+x*4:]
+			if b > 0 {
+				// border covers pixels, which are closer than border width to edge
+				blendPixel(p, borderColor, clampUnit(0.5+d+b))
+			}
+			p[3] = clampChannel(float64(p[3]) * coverage)
+		}
+	}
+
+	return dst
+}
+
+// roundedRectDistance returns signed distance from point to edge of rounded rectangle centered at zero point
+// distance is negative inside of rectangle
+func roundedRectDistance(x, y, hw, hh, r float64) float64 {
+	qx, qy := math.Abs(x)-(hw-r), math.Abs(y)-(hh-r)
+	outside := math.Hypot(math.Max(qx, 0), math.Max(qy, 0))
+	inside := math.Min(math.Max(qx, qy), 0)
+
+	return outside + inside - r
+}
+
+// blendPixel draws color with coverage over NRGBA pixel
+func blendPixel(p []uint8, c color.NRGBA, coverage float64) {
+	sa := float64(c.A) / 255 * coverage
+	da := float64(p[3]) / 255
+	a := sa + da*(1-sa)
+	if a == 0 {
+		return
+	}
+
+	for n, sc := range []uint8{c.R, c.G, c.B} {
+		p[n] = clampChannel((float64(sc)*sa + float64(p[n])*da*(1-sa)) / a)
+	}
+	p[3] = clampChannel(a * 255)
+}
+
+func clampUnit(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
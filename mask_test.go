@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetMask(t *testing.T) {
+	t.Run("circle", func(t *testing.T) {
+		fx := NewImageFixture()
+		fx.SetParams("https://golang.org/gopher.jpg", 100, 100)
+		form := url.Values{"mask": {"circle"}, "border": {"2"}, "border_color": {"ffffff"}}
+		require.NoError(t, fx.setMask(form, 2))
+		require.NoError(t, fx.setOutput(form, 2))
+
+		assert.Equal(t, 4, fx.Params.Border)
+		assert.Equal(t, []string{"mask=circle", "border=4/ffffffff"}, fx.maskName())
+		assert.Equal(t, "png", fx.Params.Format)
+	})
+	t.Run("radius to jpeg", func(t *testing.T) {
+		fx := NewImageFixture()
+		fx.SetParams("https://golang.org/gopher.jpg", 100, 100)
+		form := url.Values{"radius": {"8"}, "format": {"jpeg"}}
+		require.NoError(t, fx.setMask(form, 1))
+		require.NoError(t, fx.setOutput(form, 1))
+
+		assert.Equal(t, []string{"radius=8"}, fx.maskName())
+		assert.Equal(t, "jpeg", fx.Params.Format)
+	})
+	t.Run("border only", func(t *testing.T) {
+		fx := NewImageFixture()
+		fx.SetParams("https://golang.org/gopher.jpg", 100, 100)
+		form := url.Values{"border": {"1"}}
+		require.NoError(t, fx.setMask(form, 1))
+		require.NoError(t, fx.setOutput(form, 1))
+
+		assert.Equal(t, []string{"border=1/000000ff"}, fx.maskName())
+		assert.Equal(t, "jpeg", fx.Params.Format)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for code, form := range map[string]url.Values{
+			"invalid_mask":   {"mask": {"star"}},
+			"invalid_border": {"border_color": {"black"}},
+		} {
+			assert.Equal(t, code, newErrorBody(400, NewImageFixture().setMask(form, 1)).Code)
+		}
+		assert.Equal(t, "invalid_mask", newErrorBody(400, NewImageFixture().setMask(url.Values{"radius": {"-1"}}, 1)).Code)
+		assert.Equal(t, "invalid_border", newErrorBody(400, NewImageFixture().setMask(url.Values{"border": {"abc"}}, 1)).Code)
+	})
+}
+
+func TestMaskImage(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(img, img.Rect, image.NewUniform(red), image.Point{}, draw.Src)
+
+	t.Run("circle", func(t *testing.T) {
+		dst := maskImage(img, maskCircle, 0, 0, defaultBorderColor)
+		assert.Equal(t, red, dst.NRGBAAt(20, 10))
+		assert.Equal(t, uint8(0), dst.NRGBAAt(0, 0).A)
+		assert.Equal(t, uint8(0), dst.NRGBAAt(5, 10).A)
+		assert.Equal(t, uint8(255), dst.NRGBAAt(20, 1).A)
+
+		// edge pixel is partially covered
+		a := dst.NRGBAAt(12, 3).A
+		assert.True(t, a > 0 && a < 255, a)
+	})
+	t.Run("radius", func(t *testing.T) {
+		dst := maskImage(img, "", 6, 0, defaultBorderColor)
+		assert.Equal(t, uint8(0), dst.NRGBAAt(0, 0).A)
+		assert.Equal(t, uint8(0), dst.NRGBAAt(39, 19).A)
+		assert.Equal(t, red, dst.NRGBAAt(6, 0))
+		assert.Equal(t, red, dst.NRGBAAt(20, 10))
+	})
+	t.Run("border", func(t *testing.T) {
+		white := color.NRGBA{255, 255, 255, 255}
+		dst := maskImage(img, "", 0, 2, white)
+		assert.Equal(t, white, dst.NRGBAAt(0, 0))
+		assert.Equal(t, white, dst.NRGBAAt(1, 10))
+		assert.Equal(t, red, dst.NRGBAAt(2, 10))
+		assert.Equal(t, white, dst.NRGBAAt(39, 18))
+
+		dst = maskImage(img, maskCircle, 0, 2, white)
+		assert.Equal(t, white, dst.NRGBAAt(20, 1))
+		assert.Equal(t, red, dst.NRGBAAt(20, 3))
+		assert.Equal(t, uint8(0), dst.NRGBAAt(0, 0).A)
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// memoryRecord is a resized image kept in memory
+type memoryRecord struct {
+	key     string
+	field   string
+	data    []byte
+	header  http.Header
+	expires time.Time
+}
+
+// variantToucher is implemented by Cache, which can mark resized image as recently used without reading it
+// TouchVariant returns false if resized image is not in cache anymore
+type variantToucher interface {
+	TouchVariant(key, name string) bool
+}
+
+// MemoryCache is a Cache tier which keeps hot resized images in memory in front of another Cache
+// resized image is promoted to memory on first hit in next tier, so hits are served without disk I/O
+// hit in memory is passed to next tier, so image is kept there, and image dropped by next tier is dropped from memory
+// least recently used images are dropped when total size exceeds limit
+// originals are always served by next tier
+type MemoryCache struct {
+	next  Cache
+	ttl   time.Duration
+	limit int64
+
+	mu      sync.Mutex
+	records map[string]*list.Element
+	lru     *list.List
+	usage   int64
+	hits    int64
+	misses  int64
+}
+
+// NewMemoryCache returns new MemoryCache object in front of next Cache
+// limit is max bytes of resized images in memory, ttl is a lifetime of each of them, 0 means forever
+func NewMemoryCache(next Cache, limit int64, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		next:    next,
+		ttl:     ttl,
+		limit:   limit,
+		records: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// GetOriginal returns path to original image from next tier
+func (mc *MemoryCache) GetOriginal(key string) (string, bool) {
+	return mc.next.GetOriginal(key)
+}
+
+// SetOriginal puts original image to next tier
+func (mc *MemoryCache) SetOriginal(key, path string) (string, error) {
+	return mc.next.SetOriginal(key, path)
+}
+
+// GetVariant returns resized image and its headers from memory or from next tier
+func (mc *MemoryCache) GetVariant(key, name string) ([]byte, http.Header, bool) {
+	field := key + "/" + name
+
+	mc.mu.Lock()
+	el, ok := mc.records[field]
+	if ok && mc.ttl > 0 && time.Now().After(el.Value.(*memoryRecord).expires) {
+		mc.remove(el)
+		ok = false
+	}
+	mc.mu.Unlock()
+
+	if ok && !mc.touchNext(key, name) {
+		mc.mu.Lock()
+		if current, exists := mc.records[field]; exists && current == el {
+			mc.remove(el)
+		}
+		mc.mu.Unlock()
+		ok = false
+	}
+
+	mc.mu.Lock()
+	if ok {
+		mc.lru.MoveToFront(el)
+		mc.hits++
+		mc.mu.Unlock()
+
+		rec := el.Value.(*memoryRecord)
+		return rec.data, rec.header, true
+	}
+	mc.misses++
+	mc.mu.Unlock()
+
+	b, header, ok := mc.next.GetVariant(key, name)
+	if ok {
+		mc.promote(&memoryRecord{key: key, field: field, data: b, header: header, expires: time.Now().Add(mc.ttl)})
+	}
+
+	return b, header, ok
+}
+
+// SetVariant puts resized image to next tier, it gets to memory on first hit
+func (mc *MemoryCache) SetVariant(key, name, path string, header http.Header) error {
+	mc.mu.Lock()
+	if el, ok := mc.records[key+"/"+name]; ok {
+		mc.remove(el)
+	}
+	mc.mu.Unlock()
+
+	return mc.next.SetVariant(key, name, path, header)
+}
+
+// Remove deletes all resized images of image from memory and image from next tier
+func (mc *MemoryCache) Remove(key string) {
+	mc.mu.Lock()
+	for el := mc.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*memoryRecord).key == key {
+			mc.remove(el)
+		}
+		el = next
+	}
+	mc.mu.Unlock()
+
+	mc.next.Remove(key)
+}
+
+// Stats returns next tier stats with memory usage, hits and misses
+func (mc *MemoryCache) Stats() map[string]int64 {
+	stats := mc.next.Stats()
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	stats["memory_hits"] = mc.hits
+	stats["memory_misses"] = mc.misses
+	stats["memory_bytes"] = mc.usage
+	stats["memory_limit_bytes"] = mc.limit
+
+	return stats
+}
+
+// touchNext marks resized image as recently used in next tier and checks that it is still there
+// next tier, which can not be touched, is supposed to keep image
+func (mc *MemoryCache) touchNext(key, name string) bool {
+	t, ok := mc.next.(variantToucher)
+	return !ok || t.TouchVariant(key, name)
+}
+
+// promote puts resized image to memory and drops least recently used ones over limit
+// images bigger than limit are never promoted
+func (mc *MemoryCache) promote(rec *memoryRecord) {
+	size := int64(len(rec.data))
+	if size > mc.limit {
+		return
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if el, ok := mc.records[rec.field]; ok {
+		mc.remove(el)
+	}
+
+	for mc.usage+size > mc.limit {
+		mc.remove(mc.lru.Back())
+	}
+
+	mc.records[rec.field] = mc.lru.PushFront(rec)
+	mc.usage += size
+}
+
+func (mc *MemoryCache) remove(el *list.Element) {
+	rec := el.Value.(*memoryRecord)
+
+	mc.lru.Remove(el)
+	delete(mc.records, rec.field)
+	mc.usage -= int64(len(rec.data))
+}
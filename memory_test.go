@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/belousandrey/image-resize-service/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	next := mock.NewMockCache(ctrl)
+	cache := NewMemoryCache(next, 10, time.Minute)
+
+	small, big := []byte("12345"), []byte("123456")
+	header := http.Header{"Etag": {`"small"`}}
+
+	// each image is requested from disk tier once, then it is served from memory
+	next.EXPECT().GetVariant("key", "10x10").Return(small, header, true).Times(1)
+	next.EXPECT().GetVariant("key", "20x20").Return(big, nil, true).Times(1)
+	next.EXPECT().GetVariant("key", "30x30").Return(nil, nil, false).Times(1)
+
+	for i := 0; i < 3; i++ {
+		b, h, ok := cache.GetVariant("key", "10x10")
+		require.True(t, ok)
+		assert.Equal(t, small, b)
+		assert.Equal(t, header, h)
+	}
+
+	_, _, ok := cache.GetVariant("key", "30x30")
+	assert.False(t, ok)
+
+	// bigger image does not fit together with small one, so small one is dropped
+	b, _, ok := cache.GetVariant("key", "20x20")
+	require.True(t, ok)
+	assert.Equal(t, big, b)
+	_, _, ok = cache.GetVariant("key", "20x20")
+	assert.True(t, ok)
+
+	next.EXPECT().Stats().Return(map[string]int64{"disk_hits": 2}).Times(1)
+	stats := cache.Stats()
+	assert.Equal(t, int64(2), stats["disk_hits"])
+	assert.Equal(t, int64(3), stats["memory_hits"])
+	assert.Equal(t, int64(3), stats["memory_misses"])
+	assert.Equal(t, int64(6), stats["memory_bytes"])
+
+	next.EXPECT().GetVariant("key", "10x10").Return(nil, nil, false).Times(1)
+	_, _, ok = cache.GetVariant("key", "10x10")
+	assert.False(t, ok)
+
+	// removed image is forgotten by all tiers
+	next.EXPECT().Remove("key").Times(1)
+	cache.Remove("key")
+
+	next.EXPECT().Stats().Return(map[string]int64{}).Times(1)
+	assert.Equal(t, int64(0), cache.Stats()["memory_bytes"])
+}
+
+func TestMemoryCacheNextTier(t *testing.T) {
+	reg := NewRegistry()
+	reg.SetLimit(55)
+	defer reg.Cleanup()
+
+	next := NewTTLCache(0, reg, log.New(ioutil.Discard, "", 0))
+	cache := NewMemoryCache(next, 100, time.Minute)
+
+	for _, key := range []string{"first", "second"} {
+		_, err := cache.SetOriginal(key, tempFile(t, make([]byte, 10)))
+		require.NoError(t, err)
+		require.NoError(t, cache.SetVariant(key, "10x10", tempFile(t, make([]byte, 10)), nil))
+	}
+
+	// both images get to memory, then first one is hit in memory only
+	for _, key := range []string{"first", "second", "first"} {
+		_, _, ok := cache.GetVariant(key, "10x10")
+		require.True(t, ok)
+	}
+
+	// hit in memory is passed to disk tier, so second image is least recently used there and it is evicted
+	_, err := cache.SetOriginal("third", tempFile(t, make([]byte, 10)))
+	require.NoError(t, err)
+	require.NoError(t, cache.SetVariant("third", "10x10", tempFile(t, make([]byte, 10)), nil))
+
+	assert.True(t, next.TouchVariant("first", "10x10"))
+	assert.False(t, next.TouchVariant("second", "10x10"))
+
+	// image evicted by disk tier is not served from memory anymore
+	_, _, ok := cache.GetVariant("second", "10x10")
+	assert.False(t, ok)
+	_, _, ok = cache.GetVariant("first", "10x10")
+	assert.True(t, ok)
+}
@@ -4,6 +4,7 @@
 package mock
 
 import (
+	context "context"
 	io "io"
 
 	gomock "github.com/golang/mock/gomock"
@@ -30,24 +31,24 @@ func (_m *MockDownloader) EXPECT() *_MockDownloaderRecorder {
 	return _m.recorder
 }
 
-func (_m *MockDownloader) DownloadFile(URL string) (io.ReadCloser, error) {
-	ret := _m.ctrl.Call(_m, "DownloadFile", URL)
+func (_m *MockDownloader) DownloadFile(ctx context.Context, URL string) (io.ReadCloser, error) {
+	ret := _m.ctrl.Call(_m, "DownloadFile", ctx, URL)
 	ret0, _ := ret[0].(io.ReadCloser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockDownloaderRecorder) DownloadFile(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "DownloadFile", arg0)
+func (_mr *_MockDownloaderRecorder) DownloadFile(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DownloadFile", arg0, arg1)
 }
 
-func (_m *MockDownloader) StoreFileToTemp(URL string) (string, error) {
-	ret := _m.ctrl.Call(_m, "StoreFileToTemp", URL)
+func (_m *MockDownloader) StoreFileToTemp(ctx context.Context, URL string) (string, error) {
+	ret := _m.ctrl.Call(_m, "StoreFileToTemp", ctx, URL)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockDownloaderRecorder) StoreFileToTemp(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "StoreFileToTemp", arg0)
+func (_mr *_MockDownloaderRecorder) StoreFileToTemp(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "StoreFileToTemp", arg0, arg1)
 }
@@ -5,6 +5,8 @@ package mock
 
 import (
 	bytes "bytes"
+	context "context"
+	color "image/color"
 	io "io"
 	os "os"
 
@@ -43,52 +45,113 @@ func (_mr *_MockImagerRecorder) Open(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Open", arg0)
 }
 
-func (_m *MockImager) Decode(reader io.Reader) error {
-	ret := _m.ctrl.Call(_m, "Decode", reader)
+func (_m *MockImager) Filter(ctx context.Context, name string, value float64) error {
+	ret := _m.ctrl.Call(_m, "Filter", ctx, name, value)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockImagerRecorder) Decode(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Decode", arg0)
+func (_mr *_MockImagerRecorder) Filter(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Filter", arg0, arg1, arg2)
 }
 
-func (_m *MockImager) Encode() (*bytes.Buffer, error) {
-	ret := _m.ctrl.Call(_m, "Encode")
+func (_m *MockImager) Decode(ctx context.Context, reader io.Reader) error {
+	ret := _m.ctrl.Call(_m, "Decode", ctx, reader)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockImagerRecorder) Decode(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Decode", arg0, arg1)
+}
+
+func (_m *MockImager) Frames() int {
+	ret := _m.ctrl.Call(_m, "Frames")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockImagerRecorder) Frames() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Frames")
+}
+
+func (_m *MockImager) Frame(n int) error {
+	ret := _m.ctrl.Call(_m, "Frame", n)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockImagerRecorder) Frame(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Frame", arg0)
+}
+
+func (_m *MockImager) Encode(ctx context.Context, format string, bg color.NRGBA) (*bytes.Buffer, error) {
+	ret := _m.ctrl.Call(_m, "Encode", ctx, format, bg)
 	ret0, _ := ret[0].(*bytes.Buffer)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockImagerRecorder) Encode() *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Encode")
+func (_mr *_MockImagerRecorder) Encode(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Encode", arg0, arg1, arg2)
 }
 
-func (_m *MockImager) EncodeToWriter(writer io.Writer) error {
-	ret := _m.ctrl.Call(_m, "EncodeToWriter", writer)
+func (_m *MockImager) EncodeToWriter(ctx context.Context, writer io.Writer, format string, bg color.NRGBA) error {
+	ret := _m.ctrl.Call(_m, "EncodeToWriter", ctx, writer, format, bg)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockImagerRecorder) EncodeToWriter(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncodeToWriter", arg0)
+func (_mr *_MockImagerRecorder) EncodeToWriter(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncodeToWriter", arg0, arg1, arg2, arg3)
 }
 
-func (_m *MockImager) Resize(width uint, height uint) {
-	_m.ctrl.Call(_m, "Resize", width, height)
+func (_m *MockImager) Resize(ctx context.Context, width uint, height uint, sharpen float64) error {
+	ret := _m.ctrl.Call(_m, "Resize", ctx, width, height, sharpen)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
-func (_mr *_MockImagerRecorder) Resize(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Resize", arg0, arg1)
+func (_mr *_MockImagerRecorder) Resize(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Resize", arg0, arg1, arg2, arg3)
 }
 
-func (_m *MockImager) StoreResizedToTempFile() (string, error) {
-	ret := _m.ctrl.Call(_m, "StoreResizedToTempFile")
-	ret0, _ := ret[0].(string)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+func (_m *MockImager) Pad(ctx context.Context, pad int, bg color.NRGBA) error {
+	ret := _m.ctrl.Call(_m, "Pad", ctx, pad, bg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockImagerRecorder) Pad(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Pad", arg0, arg1, arg2)
+}
+
+func (_m *MockImager) Text(ctx context.Context, text string, size float64, fg color.NRGBA, bg color.NRGBA, position string) error {
+	ret := _m.ctrl.Call(_m, "Text", ctx, text, size, fg, bg, position)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockImagerRecorder) Text(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Text", arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
+func (_m *MockImager) Overlay(ctx context.Context, path string, position string, margin int, opacity float64, scale float64) error {
+	ret := _m.ctrl.Call(_m, "Overlay", ctx, path, position, margin, opacity, scale)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockImagerRecorder) Overlay(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Overlay", arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
+func (_m *MockImager) Mask(ctx context.Context, mask string, radius int, border int, borderColor color.NRGBA) error {
+	ret := _m.ctrl.Call(_m, "Mask", ctx, mask, radius, border, borderColor)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
-func (_mr *_MockImagerRecorder) StoreResizedToTempFile() *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "StoreResizedToTempFile")
+func (_mr *_MockImagerRecorder) Mask(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Mask", arg0, arg1, arg2, arg3, arg4)
 }
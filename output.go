@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// defaultFormat is a format of resized image if it is not requested
+const defaultFormat = "jpeg"
+
+// outputFormats contains content types of supported formats of resized image
+var outputFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+// alphaFormats are formats, which keep transparency of image, GIF keeps fully transparent pixels only
+var alphaFormats = map[string]bool{"png": true, "gif": true}
+
+// defaultBackground is a color of padding and of transparent areas of image encoded to JPEG
+var defaultBackground = color.NRGBA{255, 255, 255, 255}
+
+// setOutput reads format, background color, padding and frame of resized image
+// masked image is encoded to format with alpha channel, unless format is requested
+// animated image is resized with all frames, unless one frame or format other than GIF is requested
+// padding is set in CSS pixels, so it is multiplied by device pixel ratio
+// image is resized to fit requested size without padding
+func (fx *ImageFixture) setOutput(form url.Values, dpr float64) error {
+	if value := form.Get("format"); len(value) > 0 {
+		if _, ok := outputFormats[value]; !ok {
+			return newRequestError("invalid_format", fmt.Errorf("unknown format %s", value))
+		}
+		fx.Params.Format = value
+	} else if fx.masked() {
+		fx.Params.Format = "png"
+	}
+
+	if value := form.Get("bg"); len(value) > 0 {
+		bg, err := parseColor(value)
+		if err != nil {
+			return newRequestError("invalid_bg", errors.Wrap(err, "parse bg"))
+		}
+		fx.Params.Background = bg
+	}
+
+	if value := form.Get("pad"); len(value) > 0 {
+		pad, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return newRequestError("invalid_pad", errors.Wrap(err, "parse pad"))
+		}
+
+		fx.Params.Pad = int(math.Round(float64(pad) * dpr))
+		for _, size := range []uint64{fx.Params.Width, fx.Params.Height} {
+			if size > 0 && uint64(2*fx.Params.Pad) >= size {
+				return newRequestError("invalid_pad", fmt.Errorf("padding %d does not fit size %d", fx.Params.Pad, size))
+			}
+		}
+	}
+
+	if value := form.Get("frame"); len(value) > 0 {
+		frame, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return newRequestError("invalid_frame", errors.Wrap(err, "parse frame"))
+		}
+		fx.Params.Frame = int(frame)
+	} else if format := form.Get("format"); len(format) > 0 && format != "gif" {
+		// format without animation is requested, so first frame of animated image is resized
+		fx.Params.Frame = 0
+	}
+
+	return nil
+}
+
+// outputName returns part of variant name with padding, background and format, values by default are omitted
+func (fx *ImageFixture) outputName() []string {
+	var parts []string
+	if fx.Params.Pad > 0 {
+		parts = append(parts, "pad="+strconv.Itoa(fx.Params.Pad))
+	}
+	if fx.Params.Background != defaultBackground {
+		parts = append(parts, "bg="+colorName(fx.Params.Background))
+	}
+	if fx.Params.Format != defaultFormat {
+		parts = append(parts, "format="+fx.Params.Format)
+	}
+	if fx.Params.Frame >= 0 {
+		parts = append(parts, "frame="+strconv.Itoa(fx.Params.Frame))
+	}
+
+	return parts
+}
+
+// outputFormat returns format of resized image, animation is encoded to GIF
+// requested format other than GIF selects first frame of animation, so it is not animated anymore
+func (fx *ImageFixture) outputFormat() string {
+	if fx.File.Animated {
+		return "gif"
+	}
+
+	return fx.Params.Format
+}
+
+// contentType returns content type of resized image
+func (fx *ImageFixture) contentType() string {
+	return outputFormats[fx.outputFormat()]
+}
+
+// padImage returns copy of image with padding of background color around it
+func padImage(img image.Image, pad int, bg color.NRGBA) *image.NRGBA {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx()+2*pad, bounds.Dy()+2*pad))
+	draw.Draw(dst, dst.Rect, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(pad, pad, pad+bounds.Dx(), pad+bounds.Dy()), img, bounds.Min, draw.Over)
+
+	return dst
+}
+
+// flatten returns image with transparent areas filled with background color
+// alpha of background is ignored, opaque images are returned as is
+func flatten(img image.Image, bg color.NRGBA) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+
+	bounds := img.Bounds()
+	bg.A = 255
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Rect, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Rect, img, bounds.Min, draw.Over)
+
+	return dst
+}
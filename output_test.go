@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetOutput(t *testing.T) {
+	fx := NewImageFixture()
+	fx.SetParams("https://golang.org/gopher.jpg", 100, 0)
+	require.NoError(t, fx.setOutput(url.Values{}, 1))
+	assert.Equal(t, "jpeg", fx.Params.Format)
+	assert.Equal(t, defaultBackground, fx.Params.Background)
+	assert.Empty(t, fx.outputName())
+	assert.Equal(t, "image/jpeg", fx.contentType())
+
+	require.NoError(t, fx.setOutput(url.Values{"format": {"png"}, "bg": {"00000000"}, "pad": {"10"}}, 2))
+	assert.Equal(t, 20, fx.Params.Pad)
+	assert.Equal(t, []string{"pad=20", "bg=00000000", "format=png", "frame=0"}, fx.outputName())
+	assert.Equal(t, "image/png", fx.contentType())
+
+	// animation is kept for GIF only, other formats take first frame
+	for format, frame := range map[string]int{"gif": -1, "jpeg": 0} {
+		fx := NewImageFixture()
+		fx.SetParams("https://golang.org/loader.gif", 100, 0)
+		require.NoError(t, fx.setOutput(url.Values{"format": {format}}, 1))
+		assert.Equal(t, frame, fx.Params.Frame)
+	}
+
+	for code, form := range map[string]url.Values{
+		"invalid_format": {"format": {"webp"}},
+		"invalid_bg":     {"bg": {"white"}},
+		"invalid_pad":    {"pad": {"50"}},
+	} {
+		fx := NewImageFixture()
+		fx.SetParams("https://golang.org/gopher.jpg", 100, 0)
+		assert.Equal(t, code, newErrorBody(400, fx.setOutput(form, 1)).Code)
+	}
+}
+
+func TestImagesEncode(t *testing.T) {
+	// left half is transparent, right half is opaque red
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	draw.Draw(img, image.Rect(8, 0, 16, 16), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	i := &Images{resized: img}
+	bg := color.NRGBA{0, 0, 255, 255}
+
+	t.Run("jpeg", func(t *testing.T) {
+		buffer, err := i.Encode(context.Background(), "jpeg", bg)
+		require.NoError(t, err)
+
+		decoded, err := jpeg.Decode(buffer)
+		require.NoError(t, err)
+
+		r, g, b, _ := decoded.At(2, 8).RGBA()
+		assert.InDelta(t, 0, r>>8, 8)
+		assert.InDelta(t, 0, g>>8, 8)
+		assert.InDelta(t, 255, b>>8, 8)
+	})
+	t.Run("png", func(t *testing.T) {
+		buffer, err := i.Encode(context.Background(), "png", bg)
+		require.NoError(t, err)
+
+		decoded, err := png.Decode(buffer)
+		require.NoError(t, err)
+
+		_, _, _, a := decoded.At(2, 8).RGBA()
+		assert.Equal(t, uint32(0), a)
+	})
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := i.Encode(context.Background(), "webp", bg)
+		assert.Error(t, err)
+	})
+}
+
+func TestPadImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	draw.Draw(img, img.Rect, image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+
+	dst := padImage(img, 3, color.NRGBA{0, 0, 0, 0})
+	assert.Equal(t, image.Rect(0, 0, 10, 8), dst.Rect)
+	assert.Equal(t, color.NRGBA{}, dst.NRGBAAt(2, 2))
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, dst.NRGBAAt(3, 3))
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, dst.NRGBAAt(6, 4))
+	assert.Equal(t, color.NRGBA{}, dst.NRGBAAt(7, 5))
+
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, flatten(img, color.NRGBA{}).(*image.NRGBA).NRGBAAt(0, 0))
+	assert.Equal(t, color.NRGBA{0, 0, 255, 255}, flatten(image.NewNRGBA(image.Rect(0, 0, 1, 1)), color.NRGBA{0, 0, 255, 0}).(*image.NRGBA).NRGBAAt(0, 0))
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+)
+
+// placeholder formats, requested as format=<name>
+const (
+	placeholderBlurHash = "blurhash"
+	placeholderLQIP     = "lqip"
+	placeholderColor    = "color"
+)
+
+// lqipWidth is width of tiny JPEG placeholder
+const lqipWidth = 20
+
+// Placeholder is a response of placeholder handler
+type Placeholder struct {
+	Format      string `json:"format"`
+	Placeholder string `json:"placeholder"`
+}
+
+// placeholderHandler is a struct to serve placeholder handler
+type placeholderHandler struct {
+	cache      Cache
+	settings   *Settings
+	timeout    time.Duration
+	downloader Downloader
+	logger     *log.Logger
+}
+
+// ServeHTTP passes request to PlaceholderHandler and logs results
+func (ph *placeholderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ph.timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), ph.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	requestID := setRequestID(w, r)
+
+	status, err := PlaceholderHandler(w, r, ph.cache, ph.settings, ph.downloader)
+	if err != nil {
+		ph.logger.SetPrefix("ERROR: ")
+		ph.logger.Println("request:", requestID, "| status:", status, "| ", err.Error())
+	} else {
+		ph.logger.SetPrefix("INFO: ")
+		ph.logger.Println("request:", requestID, "| status: ", status, "| placeholder of image from "+strings.ToLower(r.Form.Get("url")))
+	}
+}
+
+// PlaceholderHandler responds with low quality placeholder of image for lazy loading
+// placeholder is a BlurHash string, tiny JPEG data URI or dominant color of image
+// placeholder is computed from original image and cached like resized images
+func PlaceholderHandler(w http.ResponseWriter, r *http.Request, c Cache, s *Settings, d Downloader) (int, error) {
+	ctx := r.Context()
+	fx := NewImageFixture()
+	fx.RequestID = r.Header.Get(requestIDHeader)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return fx.respondWithError(w, http.StatusMethodNotAllowed, newRequestError("method_not_allowed", errors.New("only GET and HEAD methods allowed")))
+	}
+	fx.Head = r.Method == http.MethodHead
+
+	r.ParseForm()
+	fx.SetParams(strings.ToLower(r.Form.Get("url")), 0, 0)
+	err := fx.validateUploadData()
+	if err != nil {
+		return fx.respondWithError(w, http.StatusBadRequest, err)
+	}
+
+	format := r.Form.Get("format")
+	switch format {
+	case "":
+		format = placeholderBlurHash
+	case placeholderBlurHash, placeholderLQIP, placeholderColor:
+	default:
+		return fx.respondWithError(w, http.StatusBadRequest, newRequestError("invalid_format", fmt.Errorf("unknown placeholder format %s", format)))
+	}
+	policy := s.CachePolicy("", fx.Params.URL)
+	name := "placeholder:" + format
+
+	b, header, exists := c.GetVariant(fx.File.Key, name)
+	if !exists {
+		b, err = fx.placeholder(ctx, c, d, format)
+		if err != nil {
+			return fx.respondWithError(w, contextErrorStatus(ctx, placeholderErrorStatus(err)), err)
+		}
+
+		path, err := writeTempFile(b)
+		if err != nil {
+			return fx.respondWithError(w, http.StatusInternalServerError, err)
+		}
+
+		fx.SetEtag(b)
+		fx.File.LastModified = time.Now()
+		header = fx.variantHeader()
+		err = c.SetVariant(fx.File.Key, name, path, header)
+		if err != nil {
+			return fx.respondWithError(w, http.StatusInternalServerError, err)
+		}
+	}
+
+	fx.setVariantHeader(header, b)
+	if fx.upToDate(r) {
+		return fx.respondWithRedirect(w, policy)
+	}
+
+	fx.setValidators(w)
+	return fx.respondWithJSON(w, Placeholder{Format: format, Placeholder: string(b)}, policy)
+}
+
+// placeholder takes original image from cache or downloads it, and computes its placeholder
+// first frame of animated image is used
+func (fx *ImageFixture) placeholder(ctx context.Context, c Cache, d Downloader, format string) ([]byte, error) {
+	path, exists := c.GetOriginal(fx.File.Key)
+	if !exists {
+		var err error
+		path, err = d.StoreFileToTemp(ctx, fx.Params.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		path, err = c.SetOriginal(fx.File.Key, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	i := &Images{}
+	if err = i.Decode(ctx, file); err != nil {
+		var requestErr *RequestError
+		if errors.As(err, &requestErr) {
+			return nil, err
+		}
+		return nil, newRequestError("unsupported_format", errors.Wrap(err, "decode image"))
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// transparent areas get default background, like in JPEG output
+	img := flatten(i.original, defaultBackground)
+
+	switch format {
+	case placeholderLQIP:
+		return lqip(img)
+	case placeholderColor:
+		return []byte(dominantColor(img)), nil
+	}
+
+	return []byte(blurHash(img, 4, 3)), nil
+}
+
+// placeholderErrorStatus returns response status for failed placeholder
+func placeholderErrorStatus(err error) int {
+	var originErr *OriginError
+	if errors.As(err, &originErr) {
+		return originErr.Status
+	}
+
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// writeTempFile writes content to new temp file and returns its path
+func writeTempFile(content []byte) (string, error) {
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(content)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// lqip returns data URI of tiny blurred JPEG copy of image
+func lqip(img image.Image) ([]byte, error) {
+	tiny := boxBlur(resize.Resize(lqipWidth, 0, img, resize.Bilinear))
+
+	buffer := new(bytes.Buffer)
+	err := jpeg.Encode(buffer, tiny, &jpeg.Options{Quality: 60})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buffer.Bytes())), nil
+}
+
+// boxBlur blurs image with 3x3 box filter, edge pixels are averaged with available neighbours
+func boxBlur(img image.Image) image.Image {
+	bounds := img.Bounds()
+	blurred := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var r, g, b, n uint32
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if !image.Pt(x+dx, y+dy).In(bounds) {
+						continue
+					}
+
+					pr, pg, pb, _ := img.At(x+dx, y+dy).RGBA()
+					r, g, b, n = r+pr, g+pg, b+pb, n+1
+				}
+			}
+
+			blurred.SetRGBA(x-bounds.Min.X, y-bounds.Min.Y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(b / n >> 8), 0xff})
+		}
+	}
+
+	return blurred
+}
+
+// dominantColor returns hex of most frequent color of image
+// colors are grouped with 4 bits per channel, result is an average color of largest group
+func dominantColor(img image.Image) string {
+	small := img
+	if img.Bounds().Dx() > 64 {
+		small = resize.Resize(64, 0, img, resize.Bilinear)
+	}
+	bounds := small.Bounds()
+
+	type bucket struct {
+		r, g, b, n uint64
+	}
+	buckets := make(map[uint32]*bucket)
+
+	var dominant *bucket
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := small.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+
+			id := r>>4<<8 | g>>4<<4 | b>>4
+			bk, ok := buckets[id]
+			if !ok {
+				bk = &bucket{}
+				buckets[id] = bk
+			}
+			bk.r, bk.g, bk.b, bk.n = bk.r+uint64(r), bk.g+uint64(g), bk.b+uint64(b), bk.n+1
+
+			if dominant == nil || bk.n > dominant.n {
+				dominant = bk
+			}
+		}
+	}
+
+	if dominant == nil {
+		return "#000000"
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", dominant.r/dominant.n, dominant.g/dominant.n, dominant.b/dominant.n)
+}
+
+// blurHashCharacters is an alphabet of base 83 encoding of BlurHash
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash encodes image to BlurHash string with x and y components, see https://blurha.sh
+// large image is downscaled first, because BlurHash keeps only low frequencies anyway
+func blurHash(img image.Image, xComponents, yComponents int) string {
+	small := img
+	if img.Bounds().Dx() > 32 {
+		small = resize.Resize(32, 0, img, resize.Bilinear)
+	}
+	bounds := small.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+
+					r, g, b, _ := small.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					factor[0] += basis * sRGBToLinear(r>>8)
+					factor[1] += basis * sRGBToLinear(g>>8)
+					factor[2] += basis * sRGBToLinear(b>>8)
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	hash := encodeBase83((xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, f := range ac {
+			actualMaximum = math.Max(actualMaximum, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximum = float64(quantisedMaximum+1) / 166
+		hash += encodeBase83(quantisedMaximum, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+
+	hash += encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		hash += encodeBase83(quantiseAC(f[0], maximum)*19*19+quantiseAC(f[1], maximum)*19+quantiseAC(f[2], maximum), 2)
+	}
+
+	return hash
+}
+
+func encodeBase83(value, length int) string {
+	var b strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		b.WriteByte(blurHashCharacters[digit])
+	}
+
+	return b.String()
+}
+
+func quantiseAC(value, maximum float64) int {
+	v := value / maximum
+	return int(math.Max(0, math.Min(18, math.Floor(math.Copysign(math.Sqrt(math.Abs(v)), v)*9+9.5))))
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
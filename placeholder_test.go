@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/belousandrey/image-resize-service/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaceholderHandler(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	registry := NewRegistry()
+	defer registry.Cleanup()
+	cache := NewTTLCache(0, registry, logger)
+	settings := NewSettings(60)
+
+	imageLocation := "https://golang.org/gopher.jpg"
+	original := tempCopy(t, "testdata/gopher.original.jpg")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downloader := mock.NewMockDownloader(ctrl)
+	downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(original, nil).Times(1)
+
+	request := func(format string) (*httptest.ResponseRecorder, Placeholder) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/placeholder", nil)
+		req.Form = url.Values{"url": {imageLocation}, "format": {format}}
+
+		handler := &placeholderHandler{cache, settings, 0, downloader, logger}
+		handler.ServeHTTP(rec, req)
+
+		var p Placeholder
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+		}
+		return rec, p
+	}
+
+	t.Run("blurhash", func(t *testing.T) {
+		rec, p := request("")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "blurhash", p.Format)
+		assert.Len(t, p.Placeholder, 28)
+		assert.NotEmpty(t, rec.Header().Get("Etag"))
+
+		// second request is served from cache
+		rec, cached := request("blurhash")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, p, cached)
+	})
+	t.Run("lqip", func(t *testing.T) {
+		rec, p := request("lqip")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		require.True(t, strings.HasPrefix(p.Placeholder, "data:image/jpeg;base64,"))
+
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p.Placeholder, "data:image/jpeg;base64,"))
+		require.NoError(t, err)
+		config, err := jpeg.DecodeConfig(strings.NewReader(string(b)))
+		require.NoError(t, err)
+		assert.Equal(t, lqipWidth, config.Width)
+	})
+	t.Run("color", func(t *testing.T) {
+		rec, p := request("color")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Regexp(t, "^#[0-9a-f]{6}$", p.Placeholder)
+	})
+	t.Run("unknown format", func(t *testing.T) {
+		rec, _ := request("webp")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestPlaceholderHandlerFormats(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	registry := NewRegistry()
+	defer registry.Cleanup()
+	cache := NewTTLCache(0, registry, logger)
+	settings := NewSettings(60)
+
+	// transparent PNG is flattened onto white background
+	transparent := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, transparent))
+	f.Close()
+
+	for _, tc := range []struct {
+		name     string
+		original string
+		color    string
+	}{
+		{"png", f.Name(), "#ffffff"},
+		{"gif", tempCopy(t, "testdata/animated.gif"), "#ff0000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			imageLocation := "https://golang.org/gopher." + tc.name
+			downloader := mock.NewMockDownloader(ctrl)
+			downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(tc.original, nil).Times(1)
+
+			handler := &placeholderHandler{cache, settings, 0, downloader, logger}
+			for _, format := range []string{"color", "blurhash"} {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", "/placeholder", nil)
+				req.Form = url.Values{"url": {imageLocation}, "format": {format}}
+				handler.ServeHTTP(rec, req)
+				require.Equal(t, http.StatusOK, rec.Code)
+
+				var p Placeholder
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+				if format == "color" {
+					assert.Equal(t, tc.color, p.Placeholder)
+				} else {
+					assert.Len(t, p.Placeholder, 28)
+				}
+			}
+		})
+	}
+}
+
+func TestBlurHash(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.RGBA{0x20, 0x40, 0x80, 0xff})
+		}
+	}
+
+	// size flag of 4x3 components, maximum of AC components, DC which is a color of solid image and 11 ACs
+	hash := blurHash(img, 4, 3)
+	require.Len(t, hash, 28)
+	assert.Equal(t, "L", hash[:1])
+	assert.Equal(t, encodeBase83(0x20<<16+0x40<<8+0x80, 4), hash[2:6])
+	assert.Equal(t, "#204080", dominantColor(img))
+}
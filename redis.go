@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// RedisCache is a Cache backend shared by several instances of service
+// every image is stored in Redis hash "image:<key>" with fields "original", "<variant>"
+// and "<variant>:header" with JSON of resized image headers
+// hash expires after ttl without writes and hits, like keys of TTLCache
+// originals are additionally kept in local cache, because Imager works with files
+type RedisCache struct {
+	pool   *redis.Pool
+	ttl    time.Duration
+	local  *TTLCache
+	logger *log.Logger
+	hits   int64
+	misses int64
+}
+
+// NewRedisPool returns pool of connections to Redis-compatible server
+func NewRedisPool(address string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address)
+		},
+	}
+}
+
+// NewRedisCache returns new RedisCache object
+// ttl is a lifetime of image in Redis, 0 means forever
+func NewRedisCache(pool *redis.Pool, ttl time.Duration, local *TTLCache, logger *log.Logger) *RedisCache {
+	return &RedisCache{pool: pool, ttl: ttl, local: local, logger: logger}
+}
+
+func (rc *RedisCache) hashKey(key string) string {
+	return "image:" + key
+}
+
+// get returns fields of image hash and prolongs image lifetime
+// all fields have to exist
+func (rc *RedisCache) get(key string, fields ...string) ([][]byte, bool) {
+	conn := rc.pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add(rc.hashKey(key)).AddFlat(fields)
+	values, err := redis.ByteSlices(conn.Do("HMGET", args...))
+	if err != nil {
+		if err != redis.ErrNil {
+			rc.logError(key, err)
+		}
+		return nil, false
+	}
+
+	for _, v := range values {
+		if v == nil {
+			return nil, false
+		}
+	}
+
+	if rc.ttl > 0 {
+		_, err = conn.Do("PEXPIRE", rc.hashKey(key), int64(rc.ttl/time.Millisecond))
+		if err != nil {
+			rc.logError(key, err)
+		}
+	}
+
+	return values, true
+}
+
+// set writes fields of image hash and prolongs image lifetime
+// fields are passed as field, value pairs
+// commands run in transaction, error of any of them is returned
+func (rc *RedisCache) set(key string, fieldValues ...interface{}) error {
+	conn := rc.pool.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
+	if err == nil {
+		err = conn.Send("HSET", redis.Args{}.Add(rc.hashKey(key)).Add(fieldValues...)...)
+	}
+	if err == nil && rc.ttl > 0 {
+		err = conn.Send("PEXPIRE", rc.hashKey(key), int64(rc.ttl/time.Millisecond))
+	}
+	if err != nil {
+		return errors.Wrap(err, "write image to redis")
+	}
+
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return errors.Wrap(err, "write image to redis")
+	}
+
+	// failed command inside transaction is an error element of EXEC reply
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return errors.Wrap(err, "write image to redis")
+		}
+	}
+
+	return nil
+}
+
+// GetOriginal returns path to local copy of original image
+// original is downloaded from Redis if there is no local copy yet
+func (rc *RedisCache) GetOriginal(key string) (string, bool) {
+	if path, ok := rc.local.GetOriginal(key); ok {
+		return path, true
+	}
+
+	values, ok := rc.get(key, "original")
+	if !ok {
+		return "", false
+	}
+
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		rc.logError(key, err)
+		return "", false
+	}
+
+	_, err = file.Write(values[0])
+	file.Close()
+	if err == nil {
+		var path string
+		path, err = rc.local.SetOriginal(key, file.Name())
+		if err == nil {
+			return path, true
+		}
+	}
+
+	os.Remove(file.Name())
+	rc.logError(key, err)
+	return "", false
+}
+
+// SetOriginal puts original image to Redis and to local cache
+func (rc *RedisCache) SetOriginal(key, path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err = rc.set(key, "original", b); err != nil {
+		return "", err
+	}
+
+	return rc.local.SetOriginal(key, path)
+}
+
+// GetVariant returns resized image and its headers from Redis
+func (rc *RedisCache) GetVariant(key, name string) ([]byte, http.Header, bool) {
+	values, ok := rc.get(key, name, name+":header")
+	if !ok {
+		atomic.AddInt64(&rc.misses, 1)
+		return nil, nil, false
+	}
+
+	var header http.Header
+	if err := json.Unmarshal(values[1], &header); err != nil {
+		rc.logError(key, err)
+		atomic.AddInt64(&rc.misses, 1)
+		return nil, nil, false
+	}
+
+	atomic.AddInt64(&rc.hits, 1)
+	return values[0], header, true
+}
+
+// TouchVariant prolongs lifetime of image in Redis, only headers of resized image are read
+func (rc *RedisCache) TouchVariant(key, name string) bool {
+	_, ok := rc.get(key, name+":header")
+	return ok
+}
+
+// SetVariant puts resized image and its headers to Redis, file with resized image is removed
+func (rc *RedisCache) SetVariant(key, name, path string, header http.Header) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	return rc.set(key, name, b, name+":header", h)
+}
+
+// Remove deletes image from Redis and from local cache
+func (rc *RedisCache) Remove(key string) {
+	conn := rc.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", rc.hashKey(key)); err != nil {
+		rc.logError(key, err)
+	}
+
+	rc.local.Remove(key)
+}
+
+// Stats returns local cache stats with Redis hits and misses of resized images
+func (rc *RedisCache) Stats() map[string]int64 {
+	stats := rc.local.Stats()
+	stats["redis_hits"] = atomic.LoadInt64(&rc.hits)
+	stats["redis_misses"] = atomic.LoadInt64(&rc.misses)
+
+	return stats
+}
+
+// logError writes Redis problem to log, for client it looks like cache miss
+func (rc *RedisCache) logError(key string, err error) {
+	rc.logger.SetPrefix("ERROR: ")
+	rc.logger.Println("redis", key, "| ", err.Error())
+}
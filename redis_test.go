@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisCache(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	logger := log.New(ioutil.Discard, "", 0)
+	ttl := time.Minute
+
+	// two replicas share one Redis server
+	first := NewRedisCache(NewRedisPool(server.Addr()), ttl, NewTTLCache(0, NewRegistry(), logger), logger)
+	second := NewRedisCache(NewRedisPool(server.Addr()), ttl, NewTTLCache(0, NewRegistry(), logger), logger)
+
+	original, err := first.SetOriginal("key", tempFile(t, []byte("original")))
+	require.NoError(t, err)
+	header := http.Header{"Etag": {`"resized"`}}
+	require.NoError(t, first.SetVariant("key", "100x100", tempFile(t, []byte("resized")), header))
+
+	_, _, ok := second.GetVariant("key", "200x200")
+	assert.False(t, ok)
+
+	b, h, ok := second.GetVariant("key", "100x100")
+	require.True(t, ok)
+	assert.Equal(t, "resized", string(b))
+	assert.Equal(t, header, h)
+
+	path, ok := second.GetOriginal("key")
+	require.True(t, ok)
+	assert.NotEqual(t, original, path)
+	b, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "original", string(b))
+
+	stats := second.Stats()
+	assert.Equal(t, int64(1), stats["redis_hits"])
+	assert.Equal(t, int64(1), stats["redis_misses"])
+	assert.Equal(t, int64(1), stats["images"])
+
+	// touch prolongs image lifetime like hit
+	server.FastForward(ttl / 2)
+	assert.True(t, first.TouchVariant("key", "100x100"))
+	assert.False(t, first.TouchVariant("key", "200x200"))
+	assert.Equal(t, ttl, server.TTL("image:key"))
+	server.FastForward(ttl)
+
+	_, _, ok = first.GetVariant("key", "100x100")
+	assert.False(t, ok)
+}
+
+func TestRedisCacheWriteError(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	logger := log.New(ioutil.Discard, "", 0)
+	cache := NewRedisCache(NewRedisPool(server.Addr()), time.Minute, NewTTLCache(0, NewRegistry(), logger), logger)
+
+	// HSET fails inside transaction, because key holds a string
+	require.NoError(t, server.Set("image:key", "string"))
+
+	path := tempFile(t, []byte("original"))
+	defer os.Remove(path)
+
+	_, err = cache.SetOriginal("key", path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "WRONGTYPE")
+}
@@ -1,34 +1,275 @@
 package main
 
 import (
+	"container/list"
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
+// registryRecord describes one temp file owned by image
+// key is a cache key of image the file belongs to
+type registryRecord struct {
+	key      string
+	file     string
+	original bool
+	size     int64
+}
+
+// registryOwner identifies record of file owned by image with cache key
+// in persistent mode files are content-addressed, so one file may be owned by several keys
+type registryOwner struct {
+	key  string
+	file string
+}
+
 // Registry for all temp files
-type Registry map[string]struct{}
+// it is safe for concurrent use: cache expiration callbacks modify it in background
+// Registry tracks disk usage and keeps resized images and originals in LRU order
+// every owner of file has its own record, file is deleted only with its last owner
+// with persistent store files are moved into it and cache index is kept on disk
+type Registry struct {
+	mu        sync.Mutex
+	records   map[registryOwner]*list.Element
+	refs      map[string]int
+	resized   *list.List
+	originals *list.List
+	usage     int64
+	limit     int64
+	store     *DiskStore
+}
+
+// NewRegistry returns new Registry object without disk usage limit
+func NewRegistry() *Registry {
+	return &Registry{
+		records:   make(map[registryOwner]*list.Element),
+		refs:      make(map[string]int),
+		resized:   list.New(),
+		originals: list.New(),
+	}
+}
+
+// SetLimit sets max bytes of all files in registry, 0 means no limit
+func (r *Registry) SetLimit(limit int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.limit = limit
+}
+
+// SetStore switches registry to persistent mode
+func (r *Registry) SetStore(store *DiskStore) {
+	r.store = store
+}
+
+// persist moves file to persistent store and returns its new path
+// in ephemeral mode file stays where it is
+func (r *Registry) persist(file string) (string, error) {
+	if r.store == nil {
+		return file, nil
+	}
+
+	return r.store.Adopt(file)
+}
+
+// saveIndex writes image metadata to persistent store index
+func (r *Registry) saveIndex(key string, md *MetaData) error {
+	if r.store == nil {
+		return nil
+	}
+
+	return r.store.Save(key, md)
+}
+
+// deleteIndex removes image metadata from persistent store index
+func (r *Registry) deleteIndex(key string) error {
+	if r.store == nil {
+		return nil
+	}
+
+	return r.store.Delete(key)
+}
+
+// Usage returns bytes of all files in registry and limit
+func (r *Registry) Usage() (usage, limit int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.usage, r.limit
+}
+
+// AddOriginalToRegistry adds new record with path to original image
+func (r *Registry) AddOriginalToRegistry(key, file string) {
+	r.add(registryRecord{key: key, file: file, original: true})
+}
+
+// AddResizedToRegistry adds new record with path to resized image
+func (r *Registry) AddResizedToRegistry(key, file string) {
+	r.add(registryRecord{key: key, file: file})
+}
+
+func (r *Registry) add(rec registryRecord) {
+	if info, err := os.Stat(rec.file); err == nil {
+		rec.size = info.Size()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	owner := registryOwner{rec.key, rec.file}
+	if el, ok := r.records[owner]; ok {
+		r.unlink(el)
+	}
+
+	l := r.resized
+	if rec.original {
+		l = r.originals
+	}
+	r.records[owner] = l.PushFront(&rec)
+
+	r.refs[rec.file]++
+	if r.refs[rec.file] == 1 {
+		r.usage += rec.size
+	}
+}
+
+// unlink removes record from registry without touching the file
+// returns true if file has no owners left
+func (r *Registry) unlink(el *list.Element) bool {
+	rec := el.Value.(*registryRecord)
+	if rec.original {
+		r.originals.Remove(el)
+	} else {
+		r.resized.Remove(el)
+	}
+	delete(r.records, registryOwner{rec.key, rec.file})
 
-// NewRegistry returns new Registry object
-func NewRegistry() Registry {
-	return make(Registry, 0)
+	r.refs[rec.file]--
+	if r.refs[rec.file] > 0 {
+		return false
+	}
+
+	delete(r.refs, rec.file)
+	r.usage -= rec.size
+	return true
 }
 
-// AddFileToRegistry adds new record with file path
-func (r Registry) AddFileToRegistry(file string) {
-	r[file] = struct{}{}
+// Touch marks file of image with key as recently used
+func (r *Registry) Touch(key, file string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.records[registryOwner{key, file}]
+	if !ok {
+		return
+	}
+
+	if el.Value.(*registryRecord).original {
+		r.originals.MoveToFront(el)
+	} else {
+		r.resized.MoveToFront(el)
+	}
+}
+
+// RemoveFileFromRegistry deletes record of file owned by image with key
+// file itself is removed only when no other image owns it
+// files unknown to registry are left untouched
+func (r *Registry) RemoveFileFromRegistry(key, file string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.records[registryOwner{key, file}]
+	if !ok {
+		return nil
+	}
+
+	if r.refs[file] == 1 {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, fmt.Sprintf("could not remove temp file %s", file))
+		}
+	}
+
+	r.unlink(el)
+	return nil
+}
+
+// Evict removes least recently used files until disk usage fits the limit
+// resized images are evicted first, originals only when no resized images left
+// files of image with key keep are never evicted, so it may exceed limit by one image
+// returns evicted records, so cache could forget about them
+func (r *Registry) Evict(keep string) ([]registryRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var evicted []registryRecord
+	for r.limit > 0 && r.usage > r.limit {
+		el := lastExcept(r.resized, keep)
+		if el == nil {
+			el = lastExcept(r.originals, keep)
+		}
+		if el == nil {
+			break
+		}
+
+		rec := el.Value.(*registryRecord)
+		if r.refs[rec.file] == 1 {
+			err := os.Remove(rec.file)
+			if err != nil && !os.IsNotExist(err) {
+				return evicted, errors.Wrap(err, fmt.Sprintf("could not evict temp file %s", rec.file))
+			}
+		}
+
+		r.unlink(el)
+		evicted = append(evicted, *rec)
+	}
+
+	return evicted, nil
+}
+
+// lastExcept returns least recently used element which does not belong to image with key
+func lastExcept(l *list.List, key string) *list.Element {
+	for el := l.Back(); el != nil; el = el.Prev() {
+		if el.Value.(*registryRecord).key != key {
+			return el
+		}
+	}
+
+	return nil
+}
+
+// Has checks if file is recorded in registry
+func (r *Registry) Has(file string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.refs[file] > 0
+}
+
+// Len returns number of files recorded in registry
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.refs)
 }
 
 // Cleanup removes all files recorded in registry and cleans registry keys
-func (r Registry) Cleanup() error {
-	for k := range r {
-		err := os.Remove(k)
-		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("could not remove temp file %s", k))
+func (r *Registry) Cleanup() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for owner, el := range r.records {
+		if r.refs[owner.file] == 1 {
+			err := os.Remove(owner.file)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("could not remove temp file %s", owner.file))
+			}
 		}
 
-		delete(r, k)
+		r.unlink(el)
 	}
 
 	return nil
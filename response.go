@@ -2,25 +2,125 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// statusClientClosedRequest is non-standard status for requests aborted by client
+const statusClientClosedRequest = 499
+
+// contextErrorStatus replaces status if error was caused by finished request context
+func contextErrorStatus(ctx context.Context, status int) int {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case context.Canceled:
+		return statusClientClosedRequest
+	}
+
+	return status
+}
+
+// RequestError is an error caused by client request
+// Code is returned to client, e.g. "invalid_width" or "unknown_preset"
+type RequestError struct {
+	Code string
+	Err  error
+}
+
+func newRequestError(code string, err error) *RequestError {
+	return &RequestError{Code: code, Err: err}
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns underlying error
+func (e *RequestError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns underlying error
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// errorBody is a JSON body of error response
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// newErrorBody describes error for client
+// messages of internal errors are hidden, client gets only status text
+func newErrorBody(status int, err error) errorBody {
+	var (
+		requestErr *RequestError
+		originErr  *OriginError
+	)
+
+	switch {
+	case status == statusClientClosedRequest:
+		return errorBody{Code: "client_closed_request", Message: "client closed request"}
+	case errors.As(err, &requestErr):
+		return errorBody{Code: requestErr.Code, Message: err.Error()}
+	case errors.As(err, &originErr):
+		return errorBody{Code: originErr.Code, Message: err.Error()}
+	case status == http.StatusGatewayTimeout:
+		return errorBody{Code: "timeout", Message: http.StatusText(status)}
+	case status == http.StatusInternalServerError:
+		return errorBody{Code: "internal_error", Message: http.StatusText(status)}
+	}
+
+	text := http.StatusText(status)
+	return errorBody{Code: strings.ReplaceAll(strings.ToLower(text), " ", "_"), Message: text}
+}
+
+// originErrorStatus returns response status for failed download of image
+func originErrorStatus(ctx context.Context, err error) int {
+	status := http.StatusBadGateway
+
+	var originErr *OriginError
+	if errors.As(err, &originErr) {
+		status = originErr.Status
+	}
+
+	return contextErrorStatus(ctx, status)
+}
+
 func (fx *ImageFixture) respondWithError(w http.ResponseWriter, status int, err error) (int, error) {
+	body := newErrorBody(status, err)
+	body.RequestID = fx.RequestID
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(status)
+	if !fx.Head {
+		json.NewEncoder(w).Encode(body)
+	}
+
 	return status, err
 }
 
-func (fx *ImageFixture) respondWithImage(w http.ResponseWriter, buffer *bytes.Buffer, URL string, ttl int) (int, error) {
-	w.Header().Set("Content-Type", "image/jpeg")
+func (fx *ImageFixture) respondWithImage(w http.ResponseWriter, buffer *bytes.Buffer, policy CachePolicy) (int, error) {
+	w.Header().Set("Content-Type", fx.contentType())
 	w.Header().Set("Content-Length", strconv.Itoa(len(buffer.Bytes())))
 
-	w.Header().Set("Etag", fx.File.Etag)
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age:%d, public", ttl))
-	w.Header().Set("Last-Modified", time.Now().Add(time.Second*600*-1).Format(http.TimeFormat))
-	w.Header().Set("Expires", time.Now().Add(time.Second*time.Duration(ttl)).Format(http.TimeFormat))
+	fx.setValidators(w)
+	setCachePolicy(w, policy)
+
+	if fx.Head {
+		w.WriteHeader(http.StatusOK)
+		return http.StatusOK, nil
+	}
 
 	_, err := w.Write(buffer.Bytes())
 	if err != nil {
@@ -30,7 +130,50 @@ func (fx *ImageFixture) respondWithImage(w http.ResponseWriter, buffer *bytes.Bu
 	return http.StatusOK, nil
 }
 
-func (fx *ImageFixture) respondWithRedirect(w http.ResponseWriter) (int, error) {
+// setCachePolicy sets Cache-Control and Expires headers of image response
+func setCachePolicy(w http.ResponseWriter, policy CachePolicy) {
+	w.Header().Set("Cache-Control", policy.String())
+	w.Header().Set("Expires", time.Now().Add(time.Second*time.Duration(policy.MaxAge)).UTC().Format(http.TimeFormat))
+}
+
+// setClientHints asks client for DPR and Width client hints, and tells caches that response depends on them
+func setClientHints(w http.ResponseWriter) {
+	w.Header().Set("Accept-CH", "Sec-CH-DPR, Sec-CH-Width, DPR, Width")
+	w.Header().Set("Vary", "Sec-CH-DPR, Sec-CH-Width, DPR, Width")
+}
+
+// setValidators sets ETag and Last-Modified headers of resized image
+func (fx *ImageFixture) setValidators(w http.ResponseWriter) {
+	w.Header().Set("Etag", fx.File.Etag)
+	if !fx.File.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", fx.File.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// respondWithJSON writes value as JSON with cache policy
+func (fx *ImageFixture) respondWithJSON(w http.ResponseWriter, v interface{}, policy CachePolicy) (int, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fx.respondWithError(w, http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	setCachePolicy(w, policy)
+	w.WriteHeader(http.StatusOK)
+
+	if !fx.Head {
+		if _, err = w.Write(b); err != nil {
+			return http.StatusOK, err
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+func (fx *ImageFixture) respondWithRedirect(w http.ResponseWriter, policy CachePolicy) (int, error) {
+	fx.setValidators(w)
+	setCachePolicy(w, policy)
 	w.WriteHeader(http.StatusNotModified)
 
 	return http.StatusNotModified, nil
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CachePolicy describes Cache-Control header of image responses
+// zero values are omitted from header, except max-age
+type CachePolicy struct {
+	MaxAge               int  `json:"max_age"`
+	SMaxAge              int  `json:"s_maxage"`
+	Immutable            bool `json:"immutable"`
+	StaleWhileRevalidate int  `json:"stale_while_revalidate"`
+	StaleIfError         int  `json:"stale_if_error"`
+}
+
+// String returns value of Cache-Control header
+func (p CachePolicy) String() string {
+	directives := []string{"public", fmt.Sprintf("max-age=%d", p.MaxAge)}
+	if p.SMaxAge > 0 {
+		directives = append(directives, fmt.Sprintf("s-maxage=%d", p.SMaxAge))
+	}
+	if p.Immutable {
+		directives = append(directives, "immutable")
+	}
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", p.StaleWhileRevalidate))
+	}
+	if p.StaleIfError > 0 {
+		directives = append(directives, fmt.Sprintf("stale-if-error=%d", p.StaleIfError))
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// fallbackMaxAge is a default browser cache lifetime of fallback image in seconds
+// it is short, so real image is shown soon after origin recovers
+const fallbackMaxAge = 60
+
+// Fallback is a default image from local file, which is resized and returned
+// instead of image failed to download or decode
+type Fallback struct {
+	Image string       `json:"image"`
+	Cache *CachePolicy `json:"cache"`
+}
+
+// CachePolicy returns cache policy for fallback image response
+func (f *Fallback) CachePolicy() CachePolicy {
+	if f.Cache != nil {
+		return *f.Cache
+	}
+
+	return CachePolicy{MaxAge: fallbackMaxAge}
+}
+
+// Origin contains settings for images from one host
+type Origin struct {
+	Cache    *CachePolicy `json:"cache"`
+	Fallback *Fallback    `json:"fallback"`
+}
+
+// Watermark is an image composited over resized image, see watermarkPositions for positions
+// margin is a distance from image edges in pixels, opacity is from 0 (invisible) to 1 (opaque), 1 if not set
+// scale is a width of watermark relative to width of image, zero means watermark is not scaled
+type Watermark struct {
+	Image    string  `json:"image"`
+	Position string  `json:"position"`
+	Margin   int     `json:"margin"`
+	Opacity  float64 `json:"opacity"`
+	Scale    float64 `json:"scale"`
+}
+
+// defaultWatermarkOpacity is an opacity of watermark if it is not set
+const defaultWatermarkOpacity = 1
+
+// UnmarshalJSON reads watermark from settings, missing opacity is set to default
+func (w *Watermark) UnmarshalJSON(b []byte) error {
+	type watermark Watermark
+	v := watermark{Opacity: defaultWatermarkOpacity}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	*w = Watermark(v)
+	return nil
+}
+
+// Preset is a named set of resize params, requested as preset=<name>
+// sharpen overrides global sharpening after downscale, zero disables it
+// watermark is a name of watermark, which is always applied to preset images
+type Preset struct {
+	Width     uint64       `json:"width"`
+	Height    uint64       `json:"height"`
+	Sharpen   *float64     `json:"sharpen"`
+	Watermark string       `json:"watermark"`
+	Cache     *CachePolicy `json:"cache"`
+}
+
+// Settings contains image processing and response settings
+// origins are matched by host of image URL
+// srcsets are named lists of widths, requested as srcset=<name>
+// sharpen is an amount of unsharp mask applied after downscale, zero disables it
+// watermarks are named local images, requested as watermark=<name>
+// overlay hosts are hosts, from which overlay images can be downloaded
+type Settings struct {
+	Cache        *CachePolicy          `json:"cache"`
+	Fallback     *Fallback             `json:"fallback"`
+	Origins      map[string]*Origin    `json:"origins"`
+	Presets      map[string]*Preset    `json:"presets"`
+	Srcsets      map[string][]uint64   `json:"srcsets"`
+	Sharpen      float64               `json:"sharpen"`
+	Watermarks   map[string]*Watermark `json:"watermarks"`
+	OverlayHosts []string              `json:"overlay_hosts"`
+}
+
+// NewSettings returns default Settings object, images are cached in browser for ttl seconds
+func NewSettings(ttl int) *Settings {
+	return &Settings{
+		Cache:      &CachePolicy{MaxAge: ttl},
+		Origins:    make(map[string]*Origin),
+		Presets:    make(map[string]*Preset),
+		Srcsets:    make(map[string][]uint64),
+		Watermarks: make(map[string]*Watermark),
+	}
+}
+
+// LoadSettings reads Settings from JSON file, missing values are taken from defaults
+func LoadSettings(path string, ttl int) (*Settings, error) {
+	s := NewSettings(ttl)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read settings")
+	}
+
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, errors.Wrap(err, "parse settings")
+	}
+
+	if s.Cache == nil {
+		s.Cache = &CachePolicy{MaxAge: ttl}
+	}
+	if s.Origins == nil {
+		s.Origins = make(map[string]*Origin)
+	}
+	if s.Presets == nil {
+		s.Presets = make(map[string]*Preset)
+	}
+	if s.Srcsets == nil {
+		s.Srcsets = make(map[string][]uint64)
+	}
+	if s.Watermarks == nil {
+		s.Watermarks = make(map[string]*Watermark)
+	}
+
+	if err = s.validateWatermarks(); err != nil {
+		return nil, errors.Wrap(err, "parse settings")
+	}
+
+	return s, nil
+}
+
+// origin returns settings for host of image URL
+func (s *Settings) origin(imageURL string) (*Origin, bool) {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return nil, false
+	}
+
+	o, ok := s.Origins[u.Hostname()]
+	return o, ok && o != nil
+}
+
+// CachePolicy returns cache policy for image response
+// preset policy takes precedence over origin policy, which takes precedence over global one
+func (s *Settings) CachePolicy(preset, imageURL string) CachePolicy {
+	if p, ok := s.Presets[preset]; ok && p != nil && p.Cache != nil {
+		return *p.Cache
+	}
+
+	if o, ok := s.origin(imageURL); ok && o.Cache != nil {
+		return *o.Cache
+	}
+
+	return *s.Cache
+}
+
+// SharpenAmount returns amount of sharpening after downscale
+// preset amount takes precedence over global one
+func (s *Settings) SharpenAmount(preset string) float64 {
+	if p, ok := s.Presets[preset]; ok && p != nil && p.Sharpen != nil {
+		return *p.Sharpen
+	}
+
+	return s.Sharpen
+}
+
+// validateWatermarks checks watermarks and watermarks of presets
+func (s *Settings) validateWatermarks() error {
+	for name, w := range s.Watermarks {
+		if w == nil || len(w.Image) == 0 {
+			return fmt.Errorf("watermark %s has no image", name)
+		}
+		if err := w.validate(); err != nil {
+			return errors.Wrapf(err, "watermark %s", name)
+		}
+	}
+
+	for name, p := range s.Presets {
+		if p == nil || len(p.Watermark) == 0 {
+			continue
+		}
+		if _, ok := s.Watermarks[p.Watermark]; !ok {
+			return fmt.Errorf("preset %s has unknown watermark %s", name, p.Watermark)
+		}
+	}
+
+	return nil
+}
+
+// FallbackImage returns fallback image for image URL
+// origin fallback takes precedence over global one
+func (s *Settings) FallbackImage(imageURL string) (*Fallback, bool) {
+	if o, ok := s.origin(imageURL); ok && o.Fallback != nil && len(o.Fallback.Image) > 0 {
+		return o.Fallback, true
+	}
+
+	if s.Fallback != nil && len(s.Fallback.Image) > 0 {
+		return s.Fallback, true
+	}
+
+	return nil, false
+}
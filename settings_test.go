@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettingsCachePolicy(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{
+		"cache": {"max_age": 60, "stale_if_error": 600},
+		"origins": {"cdn.example.com": {"cache": {"max_age": 86400, "s_maxage": 604800, "immutable": true}}},
+		"presets": {"thumb": {"width": 100, "height": 100, "cache": {"max_age": 300, "stale_while_revalidate": 30}}}
+	}`)
+	require.NoError(t, err)
+	f.Close()
+
+	s, err := LoadSettings(f.Name(), 3600)
+	require.NoError(t, err)
+
+	assert.Equal(t, "public, max-age=60, stale-if-error=600", s.CachePolicy("", "http://example.com/image.jpg").String())
+	assert.Equal(t, "public, max-age=86400, s-maxage=604800, immutable", s.CachePolicy("", "http://cdn.example.com/image.jpg").String())
+	assert.Equal(t, "public, max-age=300, stale-while-revalidate=30", s.CachePolicy("thumb", "http://cdn.example.com/image.jpg").String())
+
+	assert.Equal(t, "public, max-age=3600", NewSettings(3600).CachePolicy("thumb", "http://example.com/image.jpg").String())
+}
+
+func TestSettingsFallbackImage(t *testing.T) {
+	s := NewSettings(3600)
+
+	_, ok := s.FallbackImage("http://example.com/image.jpg")
+	assert.False(t, ok)
+
+	s.Fallback = &Fallback{Image: "default.jpg"}
+	s.Origins["cdn.example.com"] = &Origin{Fallback: &Fallback{Image: "cdn.jpg", Cache: &CachePolicy{MaxAge: 10}}}
+
+	fb, ok := s.FallbackImage("http://example.com/image.jpg")
+	require.True(t, ok)
+	assert.Equal(t, "default.jpg", fb.Image)
+	assert.Equal(t, "public, max-age=60", fb.CachePolicy().String())
+
+	fb, ok = s.FallbackImage("http://cdn.example.com/image.jpg")
+	require.True(t, ok)
+	assert.Equal(t, "cdn.jpg", fb.Image)
+	assert.Equal(t, "public, max-age=10", fb.CachePolicy().String())
+}
+
+func TestSettingsSharpenAmount(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{
+		"sharpen": 0.8,
+		"presets": {"thumb": {"width": 100, "height": 100, "sharpen": 1.5}, "raw": {"width": 100, "height": 100, "sharpen": 0}, "card": {"width": 300, "height": 200}}
+	}`)
+	require.NoError(t, err)
+	f.Close()
+
+	s, err := LoadSettings(f.Name(), 3600)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0.8, s.SharpenAmount(""))
+	assert.Equal(t, 1.5, s.SharpenAmount("thumb"))
+	assert.Equal(t, 0.0, s.SharpenAmount("raw"))
+	assert.Equal(t, 0.8, s.SharpenAmount("card"))
+}
+
+func TestSettingsWatermarks(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{"watermarks": {"logo": {"image": "logo.png"}, "faint": {"image": "logo.png", "opacity": 0.3}}}`)
+	require.NoError(t, err)
+	f.Close()
+
+	s, err := LoadSettings(f.Name(), 3600)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, s.Watermarks["logo"].Opacity)
+	assert.Equal(t, 0.3, s.Watermarks["faint"].Opacity)
+
+	for _, config := range []string{
+		`{"watermarks": {"logo": {"position": "top"}}}`,
+		`{"watermarks": {"logo": {"image": "logo.png", "position": "middle"}}}`,
+		`{"watermarks": {"logo": {"image": "logo.png", "opacity": 1.5}}}`,
+		`{"presets": {"thumb": {"width": 100, "height": 100, "watermark": "logo"}}}`,
+	} {
+		f, err := ioutil.TempFile("", "")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+
+		_, err = f.WriteString(config)
+		require.NoError(t, err)
+		f.Close()
+
+		_, err = LoadSettings(f.Name(), 3600)
+		assert.Error(t, err, config)
+	}
+}
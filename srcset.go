@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxSrcsetWidths is max number of variants requested at once
+const maxSrcsetWidths = 16
+
+// SrcsetVariant describes one resized image of srcset
+type SrcsetVariant struct {
+	Width uint64 `json:"width"`
+	URL   string `json:"url"`
+	Size  int    `json:"size"`
+	Etag  string `json:"etag"`
+}
+
+// Srcset is a response of srcset handler
+// Srcset field is ready to use value of srcset attribute of img tag
+type Srcset struct {
+	Variants []SrcsetVariant `json:"variants"`
+	Srcset   string          `json:"srcset"`
+}
+
+// srcsetHandler is a struct to serve srcset handler
+type srcsetHandler struct {
+	cache      Cache
+	settings   *Settings
+	timeout    time.Duration
+	imager     Imager
+	downloader Downloader
+	logger     *log.Logger
+}
+
+// ServeHTTP passes request to SrcsetHandler and logs results
+func (sh *srcsetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if sh.timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), sh.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	requestID := setRequestID(w, r)
+
+	status, err := SrcsetHandler(w, r, sh.cache, sh.settings, sh.imager, sh.downloader)
+	if err != nil {
+		sh.logger.SetPrefix("ERROR: ")
+		sh.logger.Println("request:", requestID, "| status:", status, "| ", err.Error())
+	} else {
+		sh.logger.SetPrefix("INFO: ")
+		sh.logger.Println("request:", requestID, "| status: ", status, "| resized srcset from "+strings.ToLower(r.Form.Get("url")))
+	}
+}
+
+// SrcsetHandler resizes image to several widths at once and responds with JSON description of them
+// image is decoded once for all widths, height of every variant keeps aspect ratio
+// resized images are put to cache, so they are served by resize handler by variant URLs
+func SrcsetHandler(w http.ResponseWriter, r *http.Request, c Cache, s *Settings, i Imager, d Downloader) (int, error) {
+	ctx := r.Context()
+	fx := NewImageFixture()
+	fx.RequestID = r.Header.Get(requestIDHeader)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return fx.respondWithError(w, http.StatusMethodNotAllowed, newRequestError("method_not_allowed", errors.New("only GET and HEAD methods allowed")))
+	}
+	fx.Head = r.Method == http.MethodHead
+
+	widths, err := fx.getSrcsetDataFromRequest(r, s)
+	if err != nil {
+		return fx.respondWithError(w, http.StatusBadRequest, err)
+	}
+
+	srcset := &Srcset{}
+	decoded := false
+	for _, width := range widths {
+		fx.Params.Width, fx.Params.Height = width, 0
+
+		b, header, exists := c.GetVariant(fx.File.Key, fx.variant())
+		if exists {
+			fx.setVariantHeader(header, b)
+			srcset.add(fx, len(b))
+			continue
+		}
+
+		if !decoded {
+			status, err := fx.decodeOriginal(ctx, c, i, d)
+			if err != nil {
+				return fx.respondWithError(w, status, err)
+			}
+			decoded = true
+		}
+
+		buffer, status, err := fx.resize(ctx, c, i)
+		if err != nil {
+			return fx.respondWithError(w, status, err)
+		}
+		srcset.add(fx, buffer.Len())
+	}
+
+	return fx.respondWithJSON(w, srcset, s.CachePolicy("", fx.Params.URL))
+}
+
+// decodeOriginal takes original image from cache or downloads it, and decodes it
+func (fx *ImageFixture) decodeOriginal(ctx context.Context, c Cache, i Imager, d Downloader) (int, error) {
+	path, exists := c.GetOriginal(fx.File.Key)
+	if !exists {
+		var err error
+		path, err = d.StoreFileToTemp(ctx, fx.Params.URL)
+		if err != nil {
+			return originErrorStatus(ctx, err), err
+		}
+
+		path, err = c.SetOriginal(fx.File.Key, path)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	fx.File.Path = path
+
+	return fx.decode(ctx, i)
+}
+
+// add appends resized image of fixture to srcset
+// variant URL is pinned to dpr=1, because width descriptor is already in device pixels
+// and DPR client hint would scale it once more
+func (s *Srcset) add(fx *ImageFixture, size int) {
+	query := url.Values{
+		"dpr":    {"1"},
+		"url":    {fx.Params.URL},
+		"width":  {strconv.FormatUint(fx.Params.Width, 10)},
+		"height": {"0"},
+	}
+	v := SrcsetVariant{Width: fx.Params.Width, URL: "/upload?" + query.Encode(), Size: size, Etag: fx.File.Etag}
+
+	s.Variants = append(s.Variants, v)
+	if len(s.Srcset) > 0 {
+		s.Srcset += ", "
+	}
+	s.Srcset += fmt.Sprintf("%s %dw", v.URL, v.Width)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/belousandrey/image-resize-service/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSrcsetHandler(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	registry := NewRegistry()
+	defer registry.Cleanup()
+	cache := NewTTLCache(0, registry, logger)
+	settings := NewSettings(60)
+	settings.Srcsets["product"] = []uint64{100, 200}
+
+	imageLocation := "https://golang.org/gopher.jpg"
+	original := tempCopy(t, "testdata/gopher.original.jpg")
+	resized, err := ioutil.ReadFile("testdata/gopher.100.100.jpg")
+	require.NoError(t, err)
+
+	t.Run("widths", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		downloader := mock.NewMockDownloader(ctrl)
+		downloader.EXPECT().StoreFileToTemp(gomock.Any(), imageLocation).Return(original, nil).Times(1)
+
+		fh, err := os.Open(original)
+		require.NoError(t, err)
+
+		imager := mock.NewMockImager(ctrl)
+		imager.EXPECT().Open(original).Return(fh, nil).Times(1)
+		imager.EXPECT().Decode(gomock.Any(), fh).Return(nil).Times(1)
+		for _, width := range []uint{100, 200} {
+			imager.EXPECT().Resize(gomock.Any(), width, uint(0), 0.0).Return(nil).Times(1)
+		}
+		imager.EXPECT().Encode(gomock.Any(), "jpeg", defaultBackground).DoAndReturn(func(interface{}, interface{}, interface{}) (*bytes.Buffer, error) {
+			return bytes.NewBuffer(resized), nil
+		}).Times(2)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/srcset", nil)
+		req.Form = url.Values{"url": {imageLocation}, "widths": {"100, 200"}}
+
+		handler := &srcsetHandler{cache, settings, 0, imager, downloader, logger}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var srcset Srcset
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&srcset))
+		require.Len(t, srcset.Variants, 2)
+		assert.Equal(t, uint64(100), srcset.Variants[0].Width)
+		assert.Equal(t, len(resized), srcset.Variants[0].Size)
+		assert.Equal(t, "/upload?dpr=1&height=0&url=https%3A%2F%2Fgolang.org%2Fgopher.jpg&width=100", srcset.Variants[0].URL)
+		assert.Equal(t, "/upload?dpr=1&height=0&url=https%3A%2F%2Fgolang.org%2Fgopher.jpg&width=100 100w, "+
+			"/upload?dpr=1&height=0&url=https%3A%2F%2Fgolang.org%2Fgopher.jpg&width=200 200w", srcset.Srcset)
+	})
+	t.Run("cached srcset", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/srcset", nil)
+		req.Form = url.Values{"url": {imageLocation}, "srcset": {"product"}}
+
+		handler := &srcsetHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger}
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var srcset Srcset
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&srcset))
+		assert.Len(t, srcset.Variants, 2)
+	})
+	t.Run("invalid widths", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		for _, form := range []url.Values{
+			{"url": {imageLocation}, "widths": {"100,abc"}},
+			{"url": {imageLocation}, "widths": {"100,4000000000"}},
+			{"url": {imageLocation}, "widths": {"8193"}},
+			{"url": {imageLocation}, "widths": {"1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17"}},
+			{"url": {imageLocation}, "srcset": {"unknown"}},
+		} {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/srcset", nil)
+			req.Form = form
+
+			handler := &srcsetHandler{cache, settings, 0, mock.NewMockImager(ctrl), mock.NewMockDownloader(ctrl), logger}
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+// tempCopy copies file to temp file, which can be handed over to cache
+func tempCopy(t *testing.T, path string) string {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	f.Close()
+	require.NoError(t, copyFile(path, f.Name()))
+
+	return f.Name()
+}
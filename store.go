@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ReneKroon/ttlcache"
+	"github.com/pkg/errors"
+)
+
+// indexRecord is on-disk representation of image metadata
+type indexRecord struct {
+	Original string              `json:"original"`
+	Resized  map[string]*variant `json:"resized"`
+	Updated  time.Time           `json:"updated"`
+}
+
+// DiskStore keeps images in directory, so cache survives restarts
+// files are named by SHA-256 of content: <dir>/ab/abcdef...
+// index of cache records is stored as one JSON file per key: <dir>/index/<key>.json
+type DiskStore struct {
+	dir string
+}
+
+// NewDiskStore returns new DiskStore object, creates directories if needed
+func NewDiskStore(dir string) (*DiskStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve cache directory")
+	}
+
+	err = os.MkdirAll(filepath.Join(dir, "index"), 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "create cache directory")
+	}
+
+	return &DiskStore{dir: dir}, nil
+}
+
+// Contains checks if file is located in store directory
+func (s *DiskStore) Contains(file string) bool {
+	return strings.HasPrefix(file, s.dir+string(filepath.Separator))
+}
+
+// Adopt moves file into store and returns its new content-addressed path
+// if store already has file with same content, moved file is removed
+func (s *DiskStore) Adopt(file string) (string, error) {
+	if s.Contains(file) {
+		return file, nil
+	}
+
+	hash, err := hashFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(s.dir, hash[:2], hash)
+	if _, err = os.Stat(target); err == nil {
+		return target, os.Remove(file)
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return "", errors.Wrap(err, "create cache directory")
+	}
+
+	err = os.Rename(file, target)
+	if err != nil {
+		// temp dir could be on another device
+		err = copyFile(file, target)
+		if err != nil {
+			return "", errors.Wrap(err, fmt.Sprintf("move %s to cache directory", file))
+		}
+		os.Remove(file)
+	}
+
+	return target, nil
+}
+
+// Save writes image metadata to index
+func (s *DiskStore) Save(key string, md *MetaData) error {
+	original, resized := md.snapshot()
+	b, err := json.Marshal(indexRecord{Original: original, Resized: resized, Updated: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	// write to temp file first, so index is never left half-written
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, "index"), key)
+	if err != nil {
+		return errors.Wrap(err, "save cache index")
+	}
+	_, err = tmp.Write(b)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.indexPath(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "save cache index")
+	}
+
+	return nil
+}
+
+// Delete removes image metadata from index
+func (s *DiskStore) Delete(key string) error {
+	err := os.Remove(s.indexPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "delete cache index")
+	}
+
+	return nil
+}
+
+// Restore loads index into cache and registry
+// records older than ttl and records without original file are deleted with their files
+// ttl 0 means records never expire, otherwise restored record lives for the rest of its ttl
+// returns number of restored images
+func (s *DiskStore) Restore(c *ttlcache.Cache, reg *Registry, ttl time.Duration) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "index", "*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	for _, path := range paths {
+		key := strings.TrimSuffix(filepath.Base(path), ".json")
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return restored, errors.Wrap(err, "read cache index")
+		}
+
+		var rec indexRecord
+		if err = json.Unmarshal(b, &rec); err != nil {
+			// broken record is useless, its files are dropped with the rest of garbage
+			s.Delete(key)
+			continue
+		}
+
+		age := time.Since(rec.Updated)
+		if (ttl > 0 && age >= ttl) || !fileExists(rec.Original) {
+			s.Delete(key)
+			continue
+		}
+
+		md := NewMetaData(rec.Original)
+		reg.AddOriginalToRegistry(key, rec.Original)
+		for name, v := range rec.Resized {
+			if v == nil || !fileExists(v.Path) {
+				continue
+			}
+
+			md.resized[name] = v
+			reg.AddResizedToRegistry(key, v.Path)
+		}
+
+		if ttl > 0 {
+			c.SetWithTTL(key, md, ttl-age)
+		} else {
+			c.Set(key, md)
+		}
+		restored++
+	}
+
+	return restored, s.removeGarbage(reg)
+}
+
+// removeGarbage deletes files in store which are not recorded in registry
+func (s *DiskStore) removeGarbage(reg *Registry) error {
+	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path == filepath.Join(s.dir, "index") {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || reg.Has(path) {
+			return nil
+		}
+
+		return os.Remove(path)
+	})
+}
+
+func (s *DiskStore) indexPath(key string) string {
+	return filepath.Join(s.dir, "index", key+".json")
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskStoreRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewDiskStore(dir)
+	require.NoError(t, err)
+
+	logger := log.New(ioutil.Discard, "", 0)
+	reg := NewRegistry()
+	reg.SetStore(store)
+	cache := NewTTLCache(0, reg, logger)
+
+	original, err := cache.SetOriginal("key", tempFile(t, []byte("original")))
+	require.NoError(t, err)
+	assert.True(t, store.Contains(original))
+
+	header := http.Header{"Etag": {`"resized"`}}
+	require.NoError(t, cache.SetVariant("key", "100x100", tempFile(t, []byte("resized")), header))
+	v, ok := cache.variant("key", "100x100")
+	require.True(t, ok)
+	assert.True(t, store.Contains(v.Path))
+	resized := v.Path
+
+	// orphan file is removed on restore
+	orphan := filepath.Join(dir, "ff", "orphan")
+	require.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0755))
+	require.NoError(t, ioutil.WriteFile(orphan, []byte("orphan"), 0644))
+
+	t.Run("restart", func(t *testing.T) {
+		reg := NewRegistry()
+		reg.SetStore(store)
+		cache := NewTTLCache(0, reg, logger)
+
+		restored, err := cache.Restore(time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 1, restored)
+		assert.Equal(t, 2, reg.Len())
+
+		path, ok := cache.GetOriginal("key")
+		require.True(t, ok)
+		assert.Equal(t, original, path)
+
+		b, h, ok := cache.GetVariant("key", "100x100")
+		require.True(t, ok)
+		assert.Equal(t, "resized", string(b))
+		assert.Equal(t, header, h)
+		assert.False(t, fileExists(orphan))
+	})
+	t.Run("no ttl", func(t *testing.T) {
+		reg := NewRegistry()
+		reg.SetStore(store)
+		cache := NewTTLCache(0, reg, logger)
+
+		restored, err := cache.Restore(0)
+		require.NoError(t, err)
+		assert.Equal(t, 1, restored)
+		assert.Equal(t, 2, reg.Len())
+		assert.True(t, fileExists(original))
+		assert.True(t, fileExists(resized))
+	})
+	t.Run("expired", func(t *testing.T) {
+		reg := NewRegistry()
+		reg.SetStore(store)
+		cache := NewTTLCache(time.Nanosecond, reg, logger)
+
+		restored, err := cache.Restore(time.Nanosecond)
+		require.NoError(t, err)
+		assert.Equal(t, 0, restored)
+		assert.Equal(t, 0, reg.Len())
+		assert.False(t, fileExists(original))
+		assert.False(t, fileExists(resized))
+	})
+}
+
+func TestDiskStoreSharedContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewDiskStore(dir)
+	require.NoError(t, err)
+
+	reg := NewRegistry()
+	reg.SetStore(store)
+	cache := NewTTLCache(100*time.Millisecond, reg, log.New(ioutil.Discard, "", 0))
+
+	// identical originals under two keys are stored once
+	first, err := cache.SetOriginal("first", tempFile(t, []byte("original")))
+	require.NoError(t, err)
+	second, err := cache.SetOriginal("second", tempFile(t, []byte("original")))
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+	assert.Equal(t, 1, reg.Len())
+
+	// second key is kept alive by hits until first one expires
+	require.Eventually(t, func() bool {
+		_, ok := cache.GetOriginal("second")
+		return ok && !fileExists(store.indexPath("first"))
+	}, time.Second, 10*time.Millisecond)
+
+	path, ok := cache.GetOriginal("second")
+	require.True(t, ok)
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "original", string(b))
+	assert.True(t, reg.Has(path))
+	assert.Equal(t, 1, reg.Len())
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// maxTextLength is max number of characters of caption
+const maxTextLength = 200
+
+// default font size in pixels and position of caption, default color is white
+const (
+	defaultTextSize     = 24
+	defaultTextPosition = "bottom"
+)
+
+// textSizeRange is a range of allowed font sizes of caption in pixels
+var textSizeRange = filterRange{6, 200}
+
+// Caption is a text drawn over resized image, requested as text=<text>
+// text is wrapped to width of image, background box is not drawn if it is transparent
+type Caption struct {
+	Text       string
+	Size       float64
+	Color      color.NRGBA
+	Background color.NRGBA
+	Position   string
+}
+
+// parseCaption reads caption from text and text_* request params, nil is returned if text is not requested
+// text size is set in CSS pixels, so it is multiplied by device pixel ratio
+func parseCaption(form url.Values, dpr float64) (*Caption, error) {
+	text := strings.TrimSpace(form.Get("text"))
+	if len(text) == 0 {
+		return nil, nil
+	}
+
+	if utf8.RuneCountInString(text) > maxTextLength {
+		return nil, newRequestError("invalid_text", fmt.Errorf("text is longer than %d characters", maxTextLength))
+	}
+
+	c := &Caption{Text: text, Size: defaultTextSize, Color: color.NRGBA{255, 255, 255, 255}, Position: defaultTextPosition}
+
+	if value := form.Get("text_size"); len(value) > 0 {
+		size, err := strconv.ParseFloat(value, 64)
+		if err != nil || size < textSizeRange.min || size > textSizeRange.max {
+			return nil, newRequestError("invalid_text", fmt.Errorf("text size has to be in range [%g, %g], got %q", textSizeRange.min, textSizeRange.max, value))
+		}
+		c.Size = size
+	}
+	c.Size *= dpr
+
+	for _, param := range []struct {
+		name  string
+		value *color.NRGBA
+	}{{"text_color", &c.Color}, {"text_bg", &c.Background}} {
+		if value := form.Get(param.name); len(value) > 0 {
+			parsed, err := parseColor(value)
+			if err != nil {
+				return nil, newRequestError("invalid_text", errors.Wrap(err, param.name))
+			}
+			*param.value = parsed
+		}
+	}
+
+	if value := form.Get("text_position"); len(value) > 0 {
+		if _, ok := watermarkPositions[value]; !ok {
+			return nil, newRequestError("invalid_text", fmt.Errorf("unknown text position %s", value))
+		}
+		c.Position = value
+	}
+
+	return c, nil
+}
+
+// parseColor parses hex color in RRGGBB or RRGGBBAA form, leading # is optional
+func parseColor(value string) (color.NRGBA, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(value, "#"))
+	if err != nil || (len(b) != 3 && len(b) != 4) {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, RRGGBB or RRGGBBAA expected", value)
+	}
+
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 255}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+
+	return c, nil
+}
+
+// colorName returns color in RRGGBBAA form
+func colorName(c color.NRGBA) string {
+	return hex.EncodeToString([]byte{c.R, c.G, c.B, c.A})
+}
+
+// textName returns part of variant name with caption, text is hashed, e.g. "text=<md5>/24/ffffffff/00000080/bottom"
+func (fx *ImageFixture) textName() string {
+	c := fx.Params.Caption
+	return fmt.Sprintf("text=%s/%s/%s/%s/%s", keyOf(c.Text), strconv.FormatFloat(c.Size, 'g', -1, 64),
+		colorName(c.Color), colorName(c.Background), c.Position)
+}
+
+// captionFont is a bundled Go Regular font, it is parsed once on first use
+var captionFont struct {
+	once sync.Once
+	font *opentype.Font
+	err  error
+}
+
+// newCaptionFace returns face of bundled font of size in pixels
+func newCaptionFace(size float64) (font.Face, error) {
+	captionFont.once.Do(func() {
+		captionFont.font, captionFont.err = opentype.Parse(goregular.TTF)
+	})
+	if captionFont.err != nil {
+		return nil, errors.Wrap(captionFont.err, "parse font")
+	}
+
+	return opentype.NewFace(captionFont.font, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// drawText returns copy of image with text drawn over it
+// text is wrapped by words to fit width of image, lines are aligned by position
+// background box with padding of quarter of font size is drawn under text
+func drawText(img image.Image, text string, size float64, fg, bg color.NRGBA, position string) (*image.NRGBA, error) {
+	face, err := newCaptionFace(size)
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	dst := toNRGBA(img)
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+	padding := int(size / 4)
+
+	lines := wrapText(face, text, fixed.I(width-2*padding))
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+
+	boxWidth := 0
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > boxWidth {
+			boxWidth = w
+		}
+	}
+	boxWidth += 2 * padding
+	boxHeight := len(lines)*lineHeight + 2*padding
+
+	if len(position) == 0 {
+		position = defaultTextPosition
+	}
+	align := watermarkPositions[position]
+	x := alignOffset(align[0], width, boxWidth, 0)
+	y := alignOffset(align[1], height, boxHeight, 0)
+
+	if bg.A > 0 {
+		draw.Draw(dst, image.Rect(x, y, x+boxWidth, y+boxHeight), image.NewUniform(bg), image.Point{}, draw.Over)
+	}
+
+	d := &font.Drawer{Dst: dst, Src: image.NewUniform(fg), Face: face}
+	for n, line := range lines {
+		lineWidth := d.MeasureString(line).Ceil()
+		lineX := x + padding + alignOffset(align[0], boxWidth-2*padding, lineWidth, 0)
+		d.Dot = fixed.P(lineX, y+padding+n*lineHeight+metrics.Ascent.Ceil())
+		d.DrawString(line)
+	}
+
+	return dst, nil
+}
+
+// wrapText splits text to lines of max width, words longer than max width take a line each
+func wrapText(face font.Face, text string, maxWidth fixed.Int26_6) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if len(line) > 0 {
+				candidate = line + " " + word
+			}
+
+			if len(line) > 0 && font.MeasureString(face, candidate) > maxWidth {
+				lines = append(lines, line)
+				candidate = word
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
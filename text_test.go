@@ -0,0 +1,88 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCaption(t *testing.T) {
+	c, err := parseCaption(url.Values{"width": {"100"}}, 1)
+	require.NoError(t, err)
+	assert.Nil(t, c)
+
+	c, err = parseCaption(url.Values{"text": {"Sale"}}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, &Caption{Text: "Sale", Size: 24, Color: color.NRGBA{255, 255, 255, 255}, Position: "bottom"}, c)
+
+	c, err = parseCaption(url.Values{"text": {"Sale"}, "text_size": {"32"}, "text_color": {"#ff0000"}, "text_bg": {"00000080"}, "text_position": {"top-left"}}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, &Caption{Text: "Sale", Size: 32, Color: color.NRGBA{255, 0, 0, 255}, Background: color.NRGBA{0, 0, 0, 128}, Position: "top-left"}, c)
+
+	// text size is in CSS pixels
+	scaled, err := parseCaption(url.Values{"text": {"Sale"}, "text_size": {"32"}}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 64.0, scaled.Size)
+
+	fx := NewImageFixture()
+	fx.Params.Caption = c
+	assert.Equal(t, "text="+keyOf("Sale")+"/32/ff0000ff/00000080/top-left", fx.textName())
+
+	for _, form := range []url.Values{
+		{"text": {strings.Repeat("a", maxTextLength+1)}},
+		{"text": {"Sale"}, "text_size": {"1000"}},
+		{"text": {"Sale"}, "text_color": {"red"}},
+		{"text": {"Sale"}, "text_bg": {"fff"}},
+		{"text": {"Sale"}, "text_position": {"middle"}},
+	} {
+		_, err = parseCaption(form, 1)
+		assert.Equal(t, "invalid_text", newErrorBody(400, err).Code, form.Encode())
+	}
+}
+
+func TestDrawText(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, img.Rect, image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+
+	t.Run("background box", func(t *testing.T) {
+		dst, err := drawText(img, "Go", 20, color.NRGBA{255, 255, 255, 255}, color.NRGBA{0, 0, 0, 255}, "bottom")
+		require.NoError(t, err)
+
+		// box is centered at bottom edge, text is drawn inside of it
+		assert.Equal(t, color.NRGBA{0, 0, 0, 255}, dst.NRGBAAt(100, 99))
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, dst.NRGBAAt(100, 0))
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, dst.NRGBAAt(0, 99))
+		assert.True(t, hasColor(dst, image.Rect(0, 60, 200, 100), color.NRGBA{255, 255, 255, 255}))
+		assert.False(t, hasColor(dst, image.Rect(0, 0, 200, 60), color.NRGBA{255, 255, 255, 255}))
+	})
+	t.Run("wrap", func(t *testing.T) {
+		face, err := newCaptionFace(20)
+		require.NoError(t, err)
+		defer face.Close()
+
+		lines := wrapText(face, "the quick brown fox jumps over the lazy dog", 20*64*8)
+		assert.True(t, len(lines) > 1)
+		assert.Equal(t, "the quick brown fox jumps over the lazy dog", strings.Join(lines, " "))
+
+		assert.Equal(t, []string{"a", "b"}, wrapText(face, "a\nb", 20*64*8))
+	})
+}
+
+// hasColor checks if any pixel of image within rectangle has color
+func hasColor(img *image.NRGBA, r image.Rectangle, c color.NRGBA) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if img.NRGBAAt(x, y) == c {
+				return true
+			}
+		}
+	}
+
+	return false
+}
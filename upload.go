@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// uploadField is a name of multipart form field with uploaded image
+const uploadField = "image"
+
+// uploadMemory is max bytes of multipart form kept in memory, the rest is written to temp files
+const uploadMemory = 1 << 20
+
+// resizeUpload resizes image uploaded by client
+// image is cached by SHA-256 of its content, so same uploads are resized once
+// downloader is used for overlay image only
+func (fx *ImageFixture) resizeUpload(w http.ResponseWriter, r *http.Request, c Cache, s *Settings, i Imager, d Downloader) (int, error) {
+	ctx := r.Context()
+
+	upload, key, err := storeUpload(r)
+	if err != nil {
+		return fx.respondWithError(w, uploadErrorStatus(err), err)
+	}
+
+	err = fx.getUploadDataFromRequest(r, s)
+	if err != nil {
+		os.Remove(upload)
+		return fx.respondWithError(w, http.StatusBadRequest, err)
+	}
+	fx.File.Key = key
+	policy := s.CachePolicy(fx.Params.Preset, "")
+
+	b, header, existsResized := c.GetVariant(fx.File.Key, fx.variant())
+	if existsResized {
+		os.Remove(upload)
+
+		fx.setVariantHeader(header, b)
+		if fx.upToDate(r) {
+			return fx.respondWithRedirect(w, policy)
+		}
+
+		return fx.respondWithImage(w, bytes.NewBuffer(b), policy)
+	}
+
+	status, err := fx.prepareWatermark(ctx, c, s, d)
+	if err != nil {
+		os.Remove(upload)
+		return fx.respondWithError(w, status, err)
+	}
+
+	path, exists := c.GetOriginal(fx.File.Key)
+	if exists {
+		os.Remove(upload)
+	} else {
+		path, err = c.SetOriginal(fx.File.Key, upload)
+		if err != nil {
+			os.Remove(upload)
+			return fx.respondWithError(w, http.StatusInternalServerError, err)
+		}
+	}
+	fx.File.Path = path
+
+	status, err = fx.decode(ctx, i)
+	if err != nil {
+		return fx.respondWithError(w, status, err)
+	}
+
+	buffer, status, err := fx.resize(ctx, c, i)
+	if err != nil {
+		return fx.respondWithError(w, status, err)
+	}
+
+	return fx.respondWithImage(w, buffer, policy)
+}
+
+// storeUpload writes uploaded image to temp file and returns its path and SHA-256 of content
+// image is taken from multipart form field "image" or from raw request body
+func storeUpload(r *http.Request) (string, string, error) {
+	var body io.Reader = r.Body
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		err := r.ParseMultipartForm(uploadMemory)
+		if err != nil {
+			return "", "", uploadError("invalid_upload", errors.Wrap(err, "parse multipart form"))
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, _, err := r.FormFile(uploadField)
+		if err != nil {
+			return "", "", newRequestError("missing_image", errors.Wrap(err, "read uploaded image"))
+		}
+		defer file.Close()
+
+		body = file
+	}
+
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", "", err
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hasher), body)
+	tempFile.Close()
+	if err == nil && size == 0 {
+		err = newRequestError("missing_image", errors.New("uploaded image is empty"))
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", "", uploadError("invalid_upload", errors.Wrap(err, "store uploaded file"))
+	}
+
+	return tempFile.Name(), hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// uploadError describes failed upload for client, body over size limit has its own code
+// errors of client request are returned as is
+func uploadError(code string, err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newRequestError("upload_too_large", err)
+	}
+
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return err
+	}
+
+	return newRequestError(code, err)
+}
+
+// uploadErrorStatus returns response status for failed upload
+func uploadErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
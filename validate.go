@@ -1,19 +1,20 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/ReneKroon/ttlcache"
 	"github.com/pkg/errors"
 )
 
-func (fx *ImageFixture) getParamsFromRequest(w http.ResponseWriter, r *http.Request) error {
-	err := fx.getUploadDataFromRequest(r)
+func (fx *ImageFixture) getParamsFromRequest(r *http.Request, s *Settings) error {
+	err := fx.getUploadDataFromRequest(r, s)
 	if err != nil {
-		fx.respondWithError(w, http.StatusBadRequest, err)
 		return err
 	}
 
@@ -25,39 +26,230 @@ func (fx *ImageFixture) getParamsFromRequest(w http.ResponseWriter, r *http.Requ
 	return nil
 }
 
-func (fx *ImageFixture) getUploadDataFromRequest(r *http.Request) error {
+// maxDPR is max device pixel ratio of requested image
+const maxDPR = 4
+
+// maxDimension is max width and height of image scaled by device pixel ratio
+const maxDimension = 8192
+
+// getUploadDataFromRequest reads URL and size of image
+// size is taken from preset settings if preset is requested
+// size is multiplied by device pixel ratio from dpr param or from DPR client hint,
+// so are other lengths in pixels: text size, watermark margin, padding, corner radius and border width
+// filters are applied to resized image, sharpening after downscale is taken from settings
+// caption and watermark are drawn over resized image, preset watermark can not be changed by request
+// mask and border of resized image are read by setMask, padding, background and format are read by setOutput
+func (fx *ImageFixture) getUploadDataFromRequest(r *http.Request, s *Settings) error {
 	r.ParseForm()
 
 	url := strings.ToLower(r.Form.Get("url"))
-	width, err := strconv.ParseUint(r.Form.Get("width"), 10, 32)
+
+	dpr, err := getDPR(r)
 	if err != nil {
 		return err
 	}
 
-	height, err := strconv.ParseUint(r.Form.Get("height"), 10, 32)
+	fx.Params.Filters, err = parseFilters(r.Form)
 	if err != nil {
 		return err
 	}
 
-	fx.SetParams(url, width, height)
+	fx.Params.Caption, err = parseCaption(r.Form, dpr)
+	if err != nil {
+		return err
+	}
+
+	if preset := r.Form.Get("preset"); len(preset) > 0 {
+		p, ok := s.Presets[preset]
+		if !ok || p == nil {
+			return newRequestError("unknown_preset", fmt.Errorf("unknown preset %s", preset))
+		}
+
+		fx.setScaledParams(url, p.Width, p.Height, dpr)
+		fx.Params.Preset = preset
+	} else if err = fx.setRequestedSize(r, url, dpr); err != nil {
+		return err
+	}
+
+	fx.Params.Sharpen = s.SharpenAmount(fx.Params.Preset)
+	if err = fx.setWatermark(r.Form, s, fx.Params.Preset, dpr); err != nil {
+		return err
+	}
+
+	if err = fx.setMask(r.Form, dpr); err != nil {
+		return err
+	}
+
+	return fx.setOutput(r.Form, dpr)
+}
+
+// setRequestedSize reads size of image from width and height params
+// if width is not requested, it is taken from Width client hint, which is already in device pixels
+func (fx *ImageFixture) setRequestedSize(r *http.Request, url string, dpr float64) error {
+	if hint := clientHint(r, "Sec-CH-Width", "Width"); len(r.Form.Get("width")) == 0 && len(hint) > 0 {
+		width, err := strconv.ParseUint(hint, 10, 32)
+		if err != nil || width == 0 {
+			return newRequestError("invalid_width", fmt.Errorf("invalid width hint %q", hint))
+		}
+
+		fx.setScaledParams(url, width, 0, 1)
+		return nil
+	}
+
+	width, err := strconv.ParseUint(r.Form.Get("width"), 10, 32)
+	if err != nil {
+		return newRequestError("invalid_width", errors.Wrap(err, "parse width"))
+	}
+
+	height, err := strconv.ParseUint(r.Form.Get("height"), 10, 32)
+	if err != nil {
+		return newRequestError("invalid_height", errors.Wrap(err, "parse height"))
+	}
+
+	fx.setScaledParams(url, width, height, dpr)
 
 	return nil
 }
 
+// getDPR reads device pixel ratio from dpr param or from DPR client hint
+// invalid client hint is ignored, because client can not fix it
+func getDPR(r *http.Request) (float64, error) {
+	if value := r.Form.Get("dpr"); len(value) > 0 {
+		dpr, err := strconv.ParseFloat(value, 64)
+		if err != nil || dpr <= 0 || dpr > maxDPR {
+			return 0, newRequestError("invalid_dpr", fmt.Errorf("dpr has to be in range (0, %d], got %q", maxDPR, value))
+		}
+
+		return dpr, nil
+	}
+
+	if hint := clientHint(r, "Sec-CH-DPR", "DPR"); len(hint) > 0 {
+		dpr, err := strconv.ParseFloat(hint, 64)
+		if err == nil && dpr > 0 {
+			return math.Min(dpr, maxDPR), nil
+		}
+	}
+
+	return 1, nil
+}
+
+// clientHint returns value of first present client hint header
+func clientHint(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(r.Header.Get(name)); len(value) > 0 {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// setScaledParams sets request params with size multiplied by device pixel ratio
+// scaled size keeps aspect ratio and fits max dimension
+func (fx *ImageFixture) setScaledParams(url string, width, height uint64, dpr float64) {
+	if dpr != 1 {
+		width, height = uint64(math.Round(float64(width)*dpr)), uint64(math.Round(float64(height)*dpr))
+	}
+	width, height = fitSize(width, height, maxDimension, maxDimension)
+
+	fx.SetParams(url, width, height)
+	fx.Params.DPR = dpr
+}
+
+// fitSize scales size down to fit max width and height, aspect ratio is kept
+// zero size means size is computed from aspect ratio of image, it is left as is
+func fitSize(width, height, maxWidth, maxHeight uint64) (uint64, uint64) {
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+
+	return width, height
+}
+
+// getSrcsetDataFromRequest reads URL and list of widths of srcset
+// widths are taken from srcset settings if srcset name is requested
+// requested widths are limited by maxDimension like size of resized image
+func (fx *ImageFixture) getSrcsetDataFromRequest(r *http.Request, s *Settings) ([]uint64, error) {
+	r.ParseForm()
+
+	fx.SetParams(strings.ToLower(r.Form.Get("url")), 0, 0)
+	fx.Params.Sharpen = s.SharpenAmount("")
+	err := fx.validateUploadData()
+	if err != nil {
+		return nil, err
+	}
+
+	if name := r.Form.Get("srcset"); len(name) > 0 {
+		widths, ok := s.Srcsets[name]
+		if !ok || len(widths) == 0 {
+			return nil, newRequestError("unknown_srcset", fmt.Errorf("unknown srcset %s", name))
+		}
+
+		return widths, nil
+	}
+
+	var widths []uint64
+	for _, value := range strings.Split(r.Form.Get("widths"), ",") {
+		width, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil || width == 0 || width > maxDimension {
+			return nil, newRequestError("invalid_widths", fmt.Errorf("width has to be in range [1, %d], got %q", maxDimension, value))
+		}
+		widths = append(widths, width)
+	}
+
+	if len(widths) > maxSrcsetWidths {
+		return nil, newRequestError("invalid_widths", fmt.Errorf("too many widths, max %d", maxSrcsetWidths))
+	}
+
+	return widths, nil
+}
+
 func (fx *ImageFixture) validateUploadData() error {
 	_, err := url.ParseRequestURI(fx.Params.URL)
 	if err != nil {
-		return errors.Wrap(err, "validate URL from incoming data")
+		return newRequestError("invalid_url", errors.Wrap(err, "validate URL from incoming data"))
 	}
 
 	return nil
 }
 
-func (fx *ImageFixture) upToDate(r *http.Request, c *ttlcache.Cache) bool {
-	ifNoneMatch := r.Header.Get("If-None-Match")
-	if len(ifNoneMatch) > 0 {
-		_, exists := fx.FindInCache(c)
-		if exists {
+// upToDate checks conditional request headers against ETag and Last-Modified of resized image
+// If-Modified-Since is ignored when If-None-Match is present, see RFC 7232 section 6
+func (fx *ImageFixture) upToDate(r *http.Request) bool {
+	if ifNoneMatch, ok := r.Header["If-None-Match"]; ok {
+		return etagListMatch(strings.Join(ifNoneMatch, ","), fx.File.Etag)
+	}
+
+	ifModifiedSince := r.Header.Get("If-Modified-Since")
+	if len(ifModifiedSince) == 0 || fx.File.LastModified.IsZero() {
+		return false
+	}
+
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	// HTTP dates have one second resolution
+	return !fx.File.LastModified.Truncate(time.Second).After(since)
+}
+
+// etagListMatch checks if list of entity tags from If-None-Match header matches etag
+// weak comparison is used, so W/"a" matches "a", and "*" matches any etag
+func etagListMatch(list, etag string) bool {
+	if len(etag) == 0 {
+		return false
+	}
+
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
 			return true
 		}
 	}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+// defaultWatermarkPosition is a position of watermark if it is not set
+const defaultWatermarkPosition = "bottom-right"
+
+// watermarkPositions contains alignment of watermark by x and y axes
+// -1 aligns watermark to left or top edge, 0 centers it, 1 aligns it to right or bottom edge
+var watermarkPositions = map[string][2]int{
+	"top-left":     {-1, -1},
+	"top":          {0, -1},
+	"top-right":    {1, -1},
+	"left":         {-1, 0},
+	"center":       {0, 0},
+	"right":        {1, 0},
+	"bottom-left":  {-1, 1},
+	"bottom":       {0, 1},
+	"bottom-right": {1, 1},
+}
+
+// validate checks position, margin, opacity and scale of watermark
+func (w *Watermark) validate() error {
+	if _, ok := watermarkPositions[w.Position]; len(w.Position) > 0 && !ok {
+		return fmt.Errorf("unknown position %s", w.Position)
+	}
+	if w.Margin < 0 || w.Margin > maxDimension {
+		return fmt.Errorf("margin has to be in range [0, %d], got %d", maxDimension, w.Margin)
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return fmt.Errorf("opacity has to be in range [0, 1], got %g", w.Opacity)
+	}
+	if w.Scale < 0 || w.Scale > 1 {
+		return fmt.Errorf("scale has to be in range [0, 1], got %g", w.Scale)
+	}
+
+	return nil
+}
+
+// setWatermark reads watermark of requested image
+// watermark of preset is always applied, so watermark params of request are ignored for such preset
+// named watermark is taken from settings, overlay image is downloaded from one of allowed hosts
+// margin is set in CSS pixels, so it is multiplied by device pixel ratio
+func (fx *ImageFixture) setWatermark(form url.Values, s *Settings, preset string, dpr float64) error {
+	var err error
+	if p, ok := s.Presets[preset]; ok && p != nil && len(p.Watermark) > 0 {
+		err = fx.setNamedWatermark(s, p.Watermark)
+	} else if name := form.Get("watermark"); len(name) > 0 {
+		err = fx.setNamedWatermark(s, name)
+	} else if overlay := form.Get("overlay"); len(overlay) > 0 {
+		err = fx.setOverlay(form, s, overlay)
+	}
+	if err != nil || fx.Params.Watermark == nil {
+		return err
+	}
+
+	fx.Params.Watermark.Margin = int(math.Round(float64(fx.Params.Watermark.Margin) * dpr))
+	return nil
+}
+
+// setNamedWatermark sets watermark from settings
+func (fx *ImageFixture) setNamedWatermark(s *Settings, name string) error {
+	w, ok := s.Watermarks[name]
+	if !ok || w == nil {
+		return newRequestError("unknown_watermark", fmt.Errorf("unknown watermark %s", name))
+	}
+
+	watermark := *w
+	fx.Params.Watermark = &watermark
+	fx.Params.WatermarkName = name
+	return nil
+}
+
+// setOverlay sets watermark from overlay URL, which has to be on one of allowed hosts
+// position, margin, opacity and scale are taken from overlay_* params
+func (fx *ImageFixture) setOverlay(form url.Values, s *Settings, overlay string) error {
+	u, err := url.ParseRequestURI(overlay)
+	if err != nil || !s.overlayAllowed(u.Hostname()) {
+		return newRequestError("invalid_overlay", fmt.Errorf("overlay %s is not allowed", overlay))
+	}
+
+	w := &Watermark{Position: form.Get("overlay_position"), Opacity: defaultWatermarkOpacity}
+	if value := form.Get("overlay_margin"); len(value) > 0 {
+		if w.Margin, err = strconv.Atoi(value); err != nil {
+			return newRequestError("invalid_overlay", fmt.Errorf("invalid overlay margin %q", value))
+		}
+	}
+	for _, param := range []struct {
+		name  string
+		value *float64
+	}{{"overlay_opacity", &w.Opacity}, {"overlay_scale", &w.Scale}} {
+		if value := form.Get(param.name); len(value) > 0 {
+			if *param.value, err = strconv.ParseFloat(value, 64); err != nil {
+				return newRequestError("invalid_overlay", fmt.Errorf("invalid %s %q", param.name, value))
+			}
+		}
+	}
+	if err = w.validate(); err != nil {
+		return newRequestError("invalid_overlay", err)
+	}
+
+	fx.Params.Watermark = w
+	fx.Params.WatermarkName = keyOf(overlay)
+	fx.Params.Overlay = overlay
+	return nil
+}
+
+// overlayAllowed checks if overlay images can be downloaded from host
+func (s *Settings) overlayAllowed(host string) bool {
+	for _, allowed := range s.OverlayHosts {
+		if host == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watermarkName returns part of variant name with watermark, e.g. "watermark=logo/bottom-right/10/0.5/0.25"
+func (fx *ImageFixture) watermarkName() string {
+	w := fx.Params.Watermark
+	return fmt.Sprintf("watermark=%s/%s/%d/%s/%s", fx.Params.WatermarkName, w.Position, w.Margin,
+		strconv.FormatFloat(w.Opacity, 'g', -1, 64), strconv.FormatFloat(w.Scale, 'g', -1, 64))
+}
+
+// prepareWatermark downloads overlay image, if it is requested, and sets path of it
+// overlay is cached as original image, so it is downloaded once
+// overlay host is checked by setOverlay, download follows redirects only to allowed overlay hosts too
+// key of overlay differs from key of original image of the same URL, which is downloaded without these checks
+func (fx *ImageFixture) prepareWatermark(ctx context.Context, c Cache, s *Settings, d Downloader) (int, error) {
+	if len(fx.Params.Overlay) == 0 {
+		return http.StatusOK, nil
+	}
+
+	key := keyOf("overlay:" + fx.Params.Overlay)
+	path, exists := c.GetOriginal(key)
+	if !exists {
+		var err error
+		path, err = d.StoreFileToTemp(withAllowedHosts(ctx, s.overlayAllowed), fx.Params.Overlay)
+		if err != nil {
+			return originErrorStatus(ctx, err), err
+		}
+
+		path, err = c.SetOriginal(key, path)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	fx.Params.Watermark.Image = path
+
+	return http.StatusOK, nil
+}
+
+// overlayImage returns copy of image with watermark drawn over it
+// watermark is scaled relative to width of image, placed at position with margin and drawn with opacity
+// watermark of zero opacity is invisible, so it is not drawn
+func overlayImage(img, watermark image.Image, position string, margin int, opacity, scale float64) *image.NRGBA {
+	dst := toNRGBA(img)
+	if opacity <= 0 {
+		return dst
+	}
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+
+	if scale > 0 {
+		w := uint(math.Max(1, math.Round(float64(width)*scale)))
+		watermark = resize.Resize(w, 0, watermark, resize.Lanczos3)
+	}
+	bounds := watermark.Bounds()
+
+	if len(position) == 0 {
+		position = defaultWatermarkPosition
+	}
+	align := watermarkPositions[position]
+	x := alignOffset(align[0], width, bounds.Dx(), margin)
+	y := alignOffset(align[1], height, bounds.Dy(), margin)
+
+	var mask image.Image
+	if opacity < 1 {
+		mask = image.NewUniform(color.Alpha{A: uint8(math.Round(opacity * 255))})
+	}
+
+	r := image.Rect(x, y, x+bounds.Dx(), y+bounds.Dy())
+	draw.DrawMask(dst, r, watermark, bounds.Min, mask, image.Point{}, draw.Over)
+
+	return dst
+}
+
+// alignOffset returns offset of watermark along axis of image size
+func alignOffset(align, size, watermark, margin int) int {
+	switch align {
+	case -1:
+		return margin
+	case 1:
+		return size - watermark - margin
+	}
+
+	return (size - watermark) / 2
+}
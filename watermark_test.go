@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetWatermark(t *testing.T) {
+	s := NewSettings(60)
+	s.Watermarks["logo"] = &Watermark{Image: "logo.png", Position: "top-left", Margin: 5, Opacity: 0.5}
+	s.Presets["partner"] = &Preset{Width: 100, Height: 100, Watermark: "logo"}
+	s.OverlayHosts = []string{"static.example.com"}
+
+	t.Run("preset", func(t *testing.T) {
+		fx := NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{"overlay": {"https://static.example.com/badge.png"}}, s, "partner", 1))
+		assert.Equal(t, "logo.png", fx.Params.Watermark.Image)
+		assert.Equal(t, "watermark=logo/top-left/5/0.5/0", fx.watermarkName())
+		assert.Empty(t, fx.Params.Overlay)
+	})
+	t.Run("named", func(t *testing.T) {
+		fx := NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{"watermark": {"logo"}}, s, "", 1))
+		assert.Equal(t, "logo", fx.Params.WatermarkName)
+
+		err := fx.setWatermark(url.Values{"watermark": {"unknown"}}, s, "", 1)
+		assert.Equal(t, "unknown_watermark", newErrorBody(400, err).Code)
+	})
+	t.Run("overlay", func(t *testing.T) {
+		overlay := "https://static.example.com/badge.png"
+		fx := NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{
+			"overlay":          {overlay},
+			"overlay_position": {"center"},
+			"overlay_margin":   {"10"},
+			"overlay_opacity":  {"0.8"},
+			"overlay_scale":    {"0.25"},
+		}, s, "", 1))
+		assert.Equal(t, overlay, fx.Params.Overlay)
+		assert.Equal(t, &Watermark{Position: "center", Margin: 10, Opacity: 0.8, Scale: 0.25}, fx.Params.Watermark)
+		assert.Equal(t, "watermark="+keyOf(overlay)+"/center/10/0.8/0.25", fx.watermarkName())
+	})
+	t.Run("dpr", func(t *testing.T) {
+		fx := NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{"watermark": {"logo"}}, s, "", 2))
+		assert.Equal(t, 10, fx.Params.Watermark.Margin)
+		assert.Equal(t, 5, s.Watermarks["logo"].Margin)
+	})
+	t.Run("overlay opacity", func(t *testing.T) {
+		overlay := "https://static.example.com/badge.png"
+		fx := NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{"overlay": {overlay}}, s, "", 1))
+		assert.Equal(t, 1.0, fx.Params.Watermark.Opacity)
+
+		fx = NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{"overlay": {overlay}, "overlay_opacity": {"0"}}, s, "", 1))
+		assert.Equal(t, 0.0, fx.Params.Watermark.Opacity)
+	})
+	t.Run("invalid overlay", func(t *testing.T) {
+		for _, form := range []url.Values{
+			{"overlay": {"https://evil.example.com/badge.png"}},
+			{"overlay": {"badge.png"}},
+			{"overlay": {"https://static.example.com/badge.png"}, "overlay_position": {"middle"}},
+			{"overlay": {"https://static.example.com/badge.png"}, "overlay_margin": {"-1"}},
+			{"overlay": {"https://static.example.com/badge.png"}, "overlay_opacity": {"2"}},
+			{"overlay": {"https://static.example.com/badge.png"}, "overlay_scale": {"abc"}},
+		} {
+			err := NewImageFixture().setWatermark(form, s, "", 1)
+			assert.Equal(t, "invalid_overlay", newErrorBody(400, err).Code, form.Encode())
+		}
+	})
+}
+
+func TestPrepareWatermarkRedirect(t *testing.T) {
+	// the same server is allowed as localhost, but not as 127.0.0.1
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/badge.png":
+			w.Write([]byte("badge"))
+		case "/allowed.png":
+			http.Redirect(w, r, "/badge.png", http.StatusFound)
+		default:
+			http.Redirect(w, r, ts.URL+"/badge.png", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+	base := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	s := NewSettings(60)
+	s.OverlayHosts = []string{"localhost"}
+
+	registry := NewRegistry()
+	defer registry.Cleanup()
+	cache := NewTTLCache(0, registry, log.New(ioutil.Discard, "", 0))
+
+	t.Run("allowed", func(t *testing.T) {
+		fx := NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{"overlay": {base + "/allowed.png"}}, s, "", 1))
+
+		_, err := fx.prepareWatermark(context.Background(), cache, s, NewDownloader())
+		require.NoError(t, err)
+		b, err := ioutil.ReadFile(fx.Params.Watermark.Image)
+		require.NoError(t, err)
+		assert.Equal(t, "badge", string(b))
+	})
+	t.Run("not allowed", func(t *testing.T) {
+		fx := NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{"overlay": {base + "/redirect.png"}}, s, "", 1))
+
+		status, err := fx.prepareWatermark(context.Background(), cache, s, NewDownloader())
+		assert.Equal(t, http.StatusBadGateway, status)
+		assert.Equal(t, "origin_redirect_not_allowed", newErrorBody(status, err).Code)
+	})
+	t.Run("cached original", func(t *testing.T) {
+		// original of the same URL is downloaded by /upload without overlay hosts check, so it is not reused
+		overlay := base + "/redirect.png"
+		_, err := cache.SetOriginal(keyOf(overlay), tempFile(t, []byte("foreign")))
+		require.NoError(t, err)
+
+		fx := NewImageFixture()
+		require.NoError(t, fx.setWatermark(url.Values{"overlay": {overlay}}, s, "", 1))
+
+		status, err := fx.prepareWatermark(context.Background(), cache, s, NewDownloader())
+		assert.Equal(t, "origin_redirect_not_allowed", newErrorBody(status, err).Code)
+	})
+}
+
+func TestOverlayImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(img, img.Rect, image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+
+	watermark := image.NewNRGBA(image.Rect(0, 0, 10, 4))
+	draw.Draw(watermark, watermark.Rect, image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+
+	t.Run("position", func(t *testing.T) {
+		dst := overlayImage(img, watermark, "", 2, 1, 0)
+		assert.Equal(t, color.NRGBA{255, 0, 0, 255}, dst.NRGBAAt(28, 14))
+		assert.Equal(t, color.NRGBA{255, 0, 0, 255}, dst.NRGBAAt(37, 17))
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, dst.NRGBAAt(38, 18))
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, dst.NRGBAAt(27, 13))
+
+		dst = overlayImage(img, watermark, "top-left", 0, 1, 0)
+		assert.Equal(t, color.NRGBA{255, 0, 0, 255}, dst.NRGBAAt(0, 0))
+
+		dst = overlayImage(img, watermark, "center", 0, 1, 0)
+		assert.Equal(t, color.NRGBA{255, 0, 0, 255}, dst.NRGBAAt(15, 8))
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, dst.NRGBAAt(14, 8))
+	})
+	t.Run("opacity", func(t *testing.T) {
+		dst := overlayImage(img, watermark, "top-left", 0, 0.5, 0)
+		c := dst.NRGBAAt(0, 0)
+		assert.InDelta(t, 128, int(c.R), 1)
+		assert.InDelta(t, 127, int(c.B), 1)
+
+		dst = overlayImage(img, watermark, "top-left", 0, 0, 0)
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, dst.NRGBAAt(0, 0))
+	})
+	t.Run("scale", func(t *testing.T) {
+		dst := overlayImage(img, watermark, "top-left", 0, 1, 0.5)
+		assert.Equal(t, color.NRGBA{255, 0, 0, 255}, dst.NRGBAAt(19, 7))
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, dst.NRGBAAt(20, 0))
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, dst.NRGBAAt(0, 8))
+	})
+}